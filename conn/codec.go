@@ -0,0 +1,174 @@
+package conn
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"io"
+	"sync"
+)
+
+var (
+	// Flate is the DEFLATE compression codec
+	Flate Codec = &flateCodec{}
+	// Gzip is the gzip compression codec
+	Gzip Codec = &gzipCodec{}
+)
+
+// Codec is a compression codec, codecs must be safe for concurrent use
+// Note: IDs 1 and 2 are used by Flate and Gzip, other codecs (e.g. snappy or zstd) may use any other non-zero ID
+type Codec interface {
+	// ID is the identifier used to negotiate the codec during the handshake
+	ID() byte
+	// Encode will append the compressed form of src to dst
+	Encode(dst, src []byte) (out []byte, err error)
+	// Decode will append the decompressed form of src to dst
+	// If the decompressed data would exceed max bytes, ErrFrameTooLarge is returned
+	Decode(dst, src []byte, max uint64) (out []byte, err error)
+}
+
+// flateCodec is the DEFLATE codec, writers and readers are pooled as they are expensive to allocate
+type flateCodec struct {
+	wp sync.Pool
+	rp sync.Pool
+}
+
+func (f *flateCodec) ID() byte {
+	return 1
+}
+
+func (f *flateCodec) Encode(dst, src []byte) (out []byte, err error) {
+	buf := bytes.NewBuffer(dst)
+
+	w, _ := f.wp.Get().(*flate.Writer)
+	if w == nil {
+		w, _ = flate.NewWriter(buf, flate.DefaultCompression)
+	} else {
+		w.Reset(buf)
+	}
+	defer f.wp.Put(w)
+
+	if _, err = w.Write(src); err != nil {
+		return
+	}
+
+	if err = w.Close(); err != nil {
+		return
+	}
+
+	return buf.Bytes(), nil
+}
+
+func (f *flateCodec) Decode(dst, src []byte, max uint64) (out []byte, err error) {
+	br := bytes.NewReader(src)
+
+	r, _ := f.rp.Get().(io.ReadCloser)
+	if r == nil {
+		r = flate.NewReader(br)
+	} else if err = r.(flate.Resetter).Reset(br, nil); err != nil {
+		return
+	}
+	defer f.rp.Put(r)
+
+	return readAll(dst, r, max)
+}
+
+// gzipCodec is the gzip codec, writers and readers are pooled as they are expensive to allocate
+type gzipCodec struct {
+	wp sync.Pool
+	rp sync.Pool
+}
+
+func (g *gzipCodec) ID() byte {
+	return 2
+}
+
+func (g *gzipCodec) Encode(dst, src []byte) (out []byte, err error) {
+	buf := bytes.NewBuffer(dst)
+
+	w, _ := g.wp.Get().(*gzip.Writer)
+	if w == nil {
+		w = gzip.NewWriter(buf)
+	} else {
+		w.Reset(buf)
+	}
+	defer g.wp.Put(w)
+
+	if _, err = w.Write(src); err != nil {
+		return
+	}
+
+	if err = w.Close(); err != nil {
+		return
+	}
+
+	return buf.Bytes(), nil
+}
+
+func (g *gzipCodec) Decode(dst, src []byte, max uint64) (out []byte, err error) {
+	br := bytes.NewReader(src)
+
+	r, _ := g.rp.Get().(*gzip.Reader)
+	if r == nil {
+		if r, err = gzip.NewReader(br); err != nil {
+			return
+		}
+	} else if err = r.Reset(br); err != nil {
+		return
+	}
+	defer g.rp.Put(r)
+
+	return readAll(dst, r, max)
+}
+
+// readAll will append the contents of r to dst, ErrFrameTooLarge is returned if r contains more than max bytes
+func readAll(dst []byte, r io.Reader, max uint64) (out []byte, err error) {
+	buf := bytes.NewBuffer(dst)
+
+	limit := int64(max) + 1
+	if limit <= 0 {
+		// max does not fit within an int64, it is effectively unlimited
+		limit = int64(^uint64(0) >> 1)
+	}
+
+	var n int64
+	if n, err = buf.ReadFrom(io.LimitReader(r, limit)); err != nil {
+		return
+	}
+
+	if uint64(n) > max {
+		return nil, ErrFrameTooLarge
+	}
+
+	return buf.Bytes(), nil
+}
+
+// negotiate will return the codecs used to encode and decode, nil codecs are returned when compression is not used
+// We encode with our most preferred codec the peer supports, and decode with the peer's most preferred codec we support
+func negotiate(codecs []Codec, ids []byte) (enc, dec Codec) {
+	for _, c := range codecs {
+		if bytes.IndexByte(ids, c.ID()) != -1 {
+			enc = c
+			break
+		}
+	}
+
+	for _, id := range ids {
+		for _, c := range codecs {
+			if c.ID() == id {
+				return enc, c
+			}
+		}
+	}
+
+	return
+}
+
+// codecIDs will return the IDs of codecs
+func codecIDs(codecs []Codec) (ids []byte) {
+	for _, c := range codecs {
+		ids = append(ids, c.ID())
+	}
+
+	return
+}
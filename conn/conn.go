@@ -1,9 +1,15 @@
 package conn
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/missionMeteora/toolkit/errors"
@@ -30,114 +36,355 @@ const (
 
 // New will return a new connection
 func New() Conn {
+	return NewWithOpts(Opts{})
+}
+
+// NewWithOpts will return a new connection with the provided options
+func NewWithOpts(opts Opts) Conn {
 	var c conn
+	opts.validate()
+	c.opts = opts
 	c.key = uuid.New()
 	c.wbuf = bytes.NewBuffer(nil)
+	if opts.ReadBufferSize > 0 {
+		c.rd = bufio.NewReaderSize(nil, opts.ReadBufferSize)
+	}
+
 	return &c
 }
 
 // Conn is a connection interface
+// Note: Reads and writes are independent, a single Conn can be read from and written to by separate goroutines at the same time
 type Conn interface {
 	Connect(nc net.Conn) (err error)
+	ConnectContext(ctx context.Context, nc net.Conn) (err error)
 	Key() string
 	Created() time.Time
+	TLS() *tls.ConnectionState
+	Version() int
 	OnConnect(fns ...OnConnectFn) Conn
 	OnDisconnect(fns ...OnDisconnectFn) Conn
 	Get(fn func([]byte)) (err error)
+	GetContext(ctx context.Context, fn func([]byte)) (err error)
 	GetStr() (msg string, err error)
+	GetInto(dst []byte) (out []byte, err error)
+	GetOwned() (o *Owned, err error)
+	GetReader(fn func(io.Reader) error) (err error)
+	GetMessage(fn func(Message)) (err error)
 	Put(b []byte) (err error)
+	PutContext(ctx context.Context, b []byte) (err error)
+	PutReader(r io.Reader, size int64) (err error)
+	PutMessage(m Message) (err error)
+	PutMessageContext(ctx context.Context, m Message) (err error)
+	PutBatch(msgs [][]byte) (err error)
+	Flush() (err error)
 	Close() (err error)
 }
 
 // conn is a connection
 type conn struct {
+	// Time we last heard from our peer as unix nanoseconds, first for 64-bit atomic alignment
+	last int64
+	// Set while a ping or pong is queued to be written
+	pinging int32
+	ponging int32
+
+	// mux guards the state and the net.Conn, it is only held briefly and never while acquiring rmux or wmux
 	mux sync.RWMutex
-	nc  net.Conn
+	// rmux serializes reads, reads never acquire wmux so a pending Get never blocks a Put
+	rmux sync.Mutex
+	// wmux serializes writes, when both are needed rmux is acquired first
+	wmux sync.Mutex
+	nc   net.Conn
 
 	key  uuid.UUID
 	rbuf buffer
+	// Read-ahead buffer, nil when read-ahead is disabled
+	rd *bufio.Reader
+	// net.Conn we are reading from, reads are wrapped so any progress updates our last seen time
+	rnc  net.Conn
+	rp   progress
 	wbuf *bytes.Buffer
-	l    lengthy
+	rh   header
+	wh   header
+
+	// Negotiated compression codecs, nil when compression is not used
+	enc Codec
+	dec Codec
+	// Compression buffers
+	cbuf []byte
+	dbuf []byte
+	// Chunked message buffer
+	mbuf []byte
+	// Stream chunk buffer
+	sbuf []byte
+	// Message buffer used to encode header blocks
+	hbuf []byte
+	// Headers of the most recently read message
+	hdrs Headers
+	// Staged buffers for vectored writes
+	bufs [][]byte
+	// Batch header and trailer buffer
+	bbuf []byte
+	// Set while a flush of our write buffer is scheduled
+	flushing bool
+
+	// Set when checksums are written, this is negotiated during the handshake
+	sums bool
+	// Checksum trailer buffers
+	rsum [checksumSize]byte
+	wsum [checksumSize]byte
 
 	onC []OnConnectFn
 	onD []OnDisconnectFn
 
-	mlen uint64
+	opts Opts
 
-	state uint8
+	// Negotiated protocol version
+	version byte
+	state   uint8
+	// Set once the OnDisconnect funcs have been called for the current connection
+	dc bool
 }
 
-// get is a raw internal call for getting a message, does not handle locking nor post-get cleanup
-func (c *conn) get(fn func([]byte)) (err error) {
+// netConn will return the current net.Conn, an error is returned if the connection is closed or idle
+func (c *conn) netConn() (nc net.Conn, err error) {
+	c.mux.RLock()
+	defer c.mux.RUnlock()
+
 	// Let's ensure our connection is not closed or idle
 	switch c.state {
 	case stateClosed:
-		return errors.ErrIsClosed
+		return nil, errors.ErrIsClosed
 	case stateIdle:
-		return ErrIsIdle
+		return nil, ErrIsIdle
 	}
 
-	// Read message length
-	if c.mlen, err = c.l.Read(c.nc); err != nil {
+	return c.nc, nil
+}
+
+// get is a raw internal call for getting a message, does not handle locking nor post-get cleanup
+// Note: n is the number of bytes read from nc
+func (c *conn) get(nc net.Conn, fn func([]byte)) (n int, err error) {
+	var (
+		f frame
+		b []byte
+	)
+
+	if f, b, n, err = c.next(nc); err != nil {
 		return
 	}
 
-	// Read message
-	if err = c.rbuf.ReadN(c.nc, c.mlen); err != nil {
-		return
+	c.hdrs = nil
+	if f.flags&flagHeaders != 0 {
+		// Our headers are only surfaced by GetMessage, the remainder is our message body
+		if c.hdrs, b, err = ReadHeaders(b); err != nil {
+			return
+		}
+	}
+
+	if f.flags&flagMore != 0 {
+		// Chunked message, assemble the chunks so they can be provided as a single message
+		c.mbuf = append(c.mbuf[:0], b...)
+		for f.flags&flagMore != 0 {
+			var cn int
+			f, b, cn, err = c.next(nc)
+			n += cn
+			if err != nil {
+				return
+			}
+
+			if uint64(len(c.mbuf)+len(b)) > c.opts.MaxFrameSize {
+				return n, ErrFrameTooLarge
+			}
+
+			c.mbuf = append(c.mbuf, b...)
+		}
+
+		b = c.mbuf
 	}
 
 	if fn != nil {
 		// Please do not use the bytes outside of the called functions\
 		// I'll be a sad panda if you create a race condition
-		fn(c.rbuf.Bytes())
+		fn(b)
 	}
 
 	return
 }
 
-// put is the raw internal call for sending a message, does not handle locking
-func (c *conn) put(b []byte) (err error) {
-	// Let's ensure our connection is not closed or idle
-	switch c.state {
-	case stateClosed:
-		return errors.ErrIsClosed
-	case stateIdle:
-		return ErrIsIdle
+// next will read the next data frame and return it's header and payload, control frames are handled along the way
+// Note: f has flagMore set when the frame is a chunk with more chunks to follow
+// Note: n is the number of bytes read from nc for the data frame
+func (c *conn) next(nc net.Conn) (f frame, b []byte, n int, err error) {
+	r := c.reader(nc)
+	for {
+		// Read frame header
+		if f, n, err = c.rh.Read(r); err != nil {
+			return
+		}
+
+		if f.len > c.opts.MaxFrameSize {
+			// Reject before allocating, the remainder of the stream cannot be trusted
+			return f, nil, n, ErrFrameTooLarge
+		}
+
+		// Read frame payload
+		err = c.rbuf.ReadN(r, f.len)
+		n += int(c.rbuf.n)
+		if err != nil {
+			return
+		}
+
+		if f.flags&flagChecksum != 0 {
+			var sn int
+			sn, err = c.verify(r, c.rbuf.Bytes())
+			n += sn
+			if err != nil {
+				return
+			}
+		}
+
+		c.seen()
+		if !f.isControl() {
+			break
+		}
+
+		// Control frames are handled internally and never surfaced, a complete control frame leaves the stream in a valid state
+		if err = c.control(nc, f); err != nil {
+			return
+		}
+
+		n = 0
+	}
+
+	b = c.rbuf.Bytes()
+	if f.flags&flagCompressed == 0 {
+		return
+	}
+
+	if c.dec == nil {
+		// Our peer is compressing without having negotiated a codec
+		return f, nil, n, ErrInvalidFrame
 	}
 
-	blen := uint64(len(b))
-	if blen < noCopySize {
-		return c.smallWrite(b, blen)
+	c.dbuf, err = c.dec.Decode(c.dbuf[:0], b, c.opts.MaxFrameSize)
+	return f, c.dbuf, n, err
+}
+
+// put is the raw internal call for sending a message, does not handle locking
+// Note: n is the number of bytes written to nc
+func (c *conn) put(nc net.Conn, b []byte) (n int, err error) {
+	return c.putFrame(nc, c.newFrame(frameData), b)
+}
+
+// putFrame will write a data frame, compressing the payload when beneficial
+// Note: n is the number of bytes written to nc
+func (c *conn) putFrame(nc net.Conn, f frame, b []byte) (n int, err error) {
+	if c.enc != nil && len(b) >= c.opts.CompressThreshold {
+		// Only send the compressed form if it is actually smaller
+		if cb, cerr := c.enc.Encode(c.cbuf[:0], b); cerr == nil && len(cb) < len(b) {
+			c.cbuf = cb
+			b = cb
+			f.flags |= flagCompressed
+		}
 	}
 
-	return c.largeWrite(b, blen)
+	f.len = uint64(len(b))
+	if f.len < noCopySize {
+		return c.smallWrite(nc, f, b)
+	}
 
+	return c.largeWrite(nc, f, b)
 }
 
-func (c *conn) smallWrite(b []byte, blen uint64) (err error) {
-	// Write the message length
-	if err = c.l.Write(c.wbuf, blen); err != nil {
+func (c *conn) smallWrite(nc net.Conn, f frame, b []byte) (n int, err error) {
+	// Stage the frame within our write buffer
+	if _, err = c.wh.Write(c.wbuf, f); err != nil {
 		return
 	}
 
 	c.wbuf.Write(b)
+	c.wbuf.Write(c.trailer(f, b))
+
+	if f.typ == frameData && c.opts.FlushInterval > 0 && c.wbuf.Len() < c.opts.FlushSize {
+		// We are buffering, our frame will be written by the next flush
+		c.schedule()
+		return
+	}
 
 	// Write message to net.Conn
-	_, err = c.nc.Write(c.wbuf.Bytes())
+	return c.flush(nc)
+}
+
+func (c *conn) largeWrite(nc net.Conn, f frame, b []byte) (n int, err error) {
+	// Stage the frame header after any buffered frames
+	if _, err = c.wh.Write(c.wbuf, f); err != nil {
+		return
+	}
+
+	// Write the buffered frames, our header, message and trailer with a single writev
+	c.bufs = append(c.bufs, c.wbuf.Bytes(), b)
+	if t := c.trailer(f, b); t != nil {
+		c.bufs = append(c.bufs, t)
+	}
+
+	return c.writev(nc)
+}
+
+// flush will write our write buffer to nc
+// Note: This is expected to be called while the write lock is held
+func (c *conn) flush(nc net.Conn) (n int, err error) {
+	if c.wbuf.Len() == 0 {
+		return
+	}
+
+	n, err = nc.Write(c.wbuf.Bytes())
 	c.wbuf.Reset()
 	return
 }
 
-func (c *conn) largeWrite(b []byte, blen uint64) (err error) {
-	// Write the message length
-	if err = c.l.Write(c.nc, blen); err != nil {
+// writev will write our staged buffers to nc, writev is used when supported by nc
+// Note: This is expected to be called while the write lock is held
+func (c *conn) writev(nc net.Conn) (n int, err error) {
+	bufs := net.Buffers(c.bufs)
+
+	var wn int64
+	wn, err = bufs.WriteTo(nc)
+
+	// Release our references to the written slices
+	for i := range c.bufs {
+		c.bufs[i] = nil
+	}
+
+	c.bufs = c.bufs[:0]
+	c.wbuf.Reset()
+	return int(wn), err
+}
+
+// schedule will schedule a flush of our write buffer after the flush interval, if one is not already scheduled
+// Note: This is expected to be called while the write lock is held
+func (c *conn) schedule() {
+	if c.flushing {
 		return
 	}
 
-	// Write message to net.Conn
-	_, err = c.nc.Write(b)
-	return
+	c.flushing = true
+	time.AfterFunc(c.opts.FlushInterval, func() {
+		c.wmux.Lock()
+		defer c.wmux.Unlock()
+
+		c.flushing = false
+
+		nc, err := c.netConn()
+		if err != nil {
+			return
+		}
+
+		if _, err = c.flush(nc); err != nil {
+			c.setIdle(nc)
+		}
+	})
 }
 
 func (c *conn) onConnect() (err error) {
@@ -150,6 +397,25 @@ func (c *conn) onConnect() (err error) {
 	return
 }
 
+// reader will return the reader for nc, the read-ahead buffer is reset whenever nc changes
+// Note: This is expected to be called while the read lock is held
+func (c *conn) reader(nc net.Conn) io.Reader {
+	if c.rnc != nc {
+		c.rp = progress{c: c, r: nc}
+		c.rnc = nc
+		if c.rd != nil {
+			// Anything buffered belongs to a previous net.Conn
+			c.rd.Reset(&c.rp)
+		}
+	}
+
+	if c.rd == nil {
+		return &c.rp
+	}
+
+	return c.rd
+}
+
 func (c *conn) onDisconnect() {
 	for _, fn := range c.onD {
 		fn(c)
@@ -163,14 +429,23 @@ func (c *conn) setConnection(nc net.Conn) (err error) {
 	} else {
 		c.nc = nc
 		c.state = stateConnected
+		c.dc = false
+		c.seen()
+		atomic.StoreInt32(&c.pinging, 0)
+		atomic.StoreInt32(&c.ponging, 0)
 	}
 	c.mux.Unlock()
 	return
 }
 
-func (c *conn) setIdle() {
-	if c.state == stateIdle {
-		// conn is already idle, return early
+// setIdle will set the state to idle if nc is still the active net.Conn
+// Note: ok is true if the state was changed
+func (c *conn) setIdle(nc net.Conn) (ok bool) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	if c.state != stateConnected || c.nc != nc {
+		// conn is already idle, closed, or has been re-connected. Return early
 		return
 	}
 
@@ -182,6 +457,21 @@ func (c *conn) setIdle() {
 	// Update conn values
 	c.nc = nil
 	c.state = stateIdle
+	return true
+}
+
+// disconnected will mark the OnDisconnect funcs as called for the current connection
+// Note: ok is false if they have already been called
+func (c *conn) disconnected() (ok bool) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	if c.dc {
+		return false
+	}
+
+	c.dc = true
+	return true
 }
 
 // close will set the state to closed
@@ -198,13 +488,84 @@ func (c *conn) close() (err error) {
 	return
 }
 
-// Connect will connect a connection to a net.Conn
+// Connect will connect a connection to a net.Conn, exchanging protocol handshakes with the peer
+// Note: If the handshake or an OnConnect func fails, the net.Conn is closed and the connection is returned to idle
 func (c *conn) Connect(nc net.Conn) (err error) {
+	return c.ConnectContext(context.Background(), nc)
+}
+
+// ConnectContext will connect a connection to a net.Conn, the deadline and cancellation of ctx are applied to the handshakes
+// Note: Handshakes must also complete within the handshake timeout, errors are handled the same as Connect
+func (c *conn) ConnectContext(ctx context.Context, nc net.Conn) (err error) {
 	if err = c.setConnection(nc); err != nil {
 		return
 	}
 
-	return c.onConnect()
+	hctx, cancel := context.WithTimeout(ctx, handshakeTimeout)
+	defer cancel()
+
+	// TLS connections complete their handshake before our OnConnect funcs so the peer certificates are available
+	if err = handshake(hctx, nc); err == nil {
+		err = c.exchange(hctx, nc)
+	}
+
+	if err != nil {
+		err = handshakeErr(ctx, err)
+	}
+
+	if err == nil {
+		err = c.onConnect()
+	}
+
+	if err != nil {
+		c.setIdle(nc)
+		return
+	}
+
+	if c.opts.Heartbeat > 0 {
+		go c.heartbeat(nc, c.opts.Heartbeat, c.opts.HeartbeatMisses)
+	}
+
+	return
+}
+
+// exchange will exchange protocol handshakes with our peer
+func (c *conn) exchange(ctx context.Context, nc net.Conn) (err error) {
+	c.rmux.Lock()
+	defer c.rmux.Unlock()
+	c.wmux.Lock()
+	defer c.wmux.Unlock()
+
+	var (
+		version byte
+		ids     []byte
+	)
+
+	if version, ids, err = exchange(ctx, nc, c.opts.Codecs); err != nil {
+		return
+	}
+
+	// Note: enc and dec are guarded by wmux and rmux respectively
+	c.enc, c.dec = negotiate(c.opts.Codecs, ids)
+	// Discard anything buffered for a previous net.Conn
+	c.wbuf.Reset()
+	// Older peers cannot verify checksums
+	c.sums = c.opts.Checksums && version >= 3
+	// Older peers only understand fixed size headers
+	c.rh.compact = version >= 5
+	c.wh.compact = version >= 5
+
+	c.mux.Lock()
+	c.version = version
+	c.mux.Unlock()
+	return
+}
+
+// Version will return the negotiated protocol version, zero is returned if the connection has never connected
+func (c *conn) Version() int {
+	c.mux.RLock()
+	defer c.mux.RUnlock()
+	return int(c.version)
 }
 
 // Key will return the generated key for a connection
@@ -219,6 +580,21 @@ func (c *conn) Created() time.Time {
 	return c.key.Time()
 }
 
+// TLS will return the TLS connection state, nil is returned if the connection is not connected over TLS
+// Note: This can be used within OnConnect funcs to identify peers by their certificates
+func (c *conn) TLS() *tls.ConnectionState {
+	c.mux.RLock()
+	defer c.mux.RUnlock()
+
+	tc, ok := c.nc.(*tls.Conn)
+	if !ok {
+		return nil
+	}
+
+	cs := tc.ConnectionState()
+	return &cs
+}
+
 // OnConnect will append an OnConnect func, referenced conn is returned for chaining
 // Note: This function is intended to be called before connection, it is NOT thread-safe
 func (c *conn) OnConnect(fns ...OnConnectFn) Conn {
@@ -234,13 +610,58 @@ func (c *conn) OnDisconnect(fns ...OnDisconnectFn) Conn {
 }
 
 // Get will get a message
+// Note: The bytes are only valid within fn, use GetInto or GetOwned to retain messages
 // Note: If fn is nil, the message will be read and discarded
+// Note: Frames larger than the maximum frame size return ErrFrameTooLarge and the connection is set to idle
+// Note: Get and Put may be called concurrently
 func (c *conn) Get(fn func([]byte)) (err error) {
-	c.mux.Lock()
-	if err = c.get(fn); err != nil {
-		c.setIdle()
+	c.rmux.Lock()
+	defer c.rmux.Unlock()
+
+	var nc net.Conn
+	if nc, err = c.netConn(); err != nil {
+		return
 	}
-	c.mux.Unlock()
+
+	if _, err = c.get(nc, fn); err != nil {
+		c.setIdle(nc)
+	}
+
+	return
+}
+
+// GetContext will get a message, the deadline and cancellation of ctx are applied to the read
+// Note: If ctx ends before any of the message has been read, the connection remains connected.
+// If ctx ends mid-message, the connection is set to idle as the stream can no longer be trusted
+func (c *conn) GetContext(ctx context.Context, fn func([]byte)) (err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+
+	c.rmux.Lock()
+	defer c.rmux.Unlock()
+
+	var nc net.Conn
+	if nc, err = c.netConn(); err != nil {
+		return
+	}
+
+	var n int
+	end := watch(ctx, nc.SetReadDeadline)
+	n, err = c.get(nc, fn)
+	end()
+
+	if err == nil {
+		return
+	}
+
+	var caused bool
+	if err, caused = contextErr(ctx, err); caused && n == 0 {
+		// Nothing was read, our connection is still in a valid state
+		return
+	}
+
+	c.setIdle(nc)
 	return
 }
 
@@ -254,14 +675,259 @@ func (c *conn) GetStr() (msg string, err error) {
 	return
 }
 
+// GetInto will get a message and append it to dst, the resulting slice is returned and owned by the caller
+// Note: dst may be reused across calls (e.g. GetInto(buf[:0])) to avoid allocations
+func (c *conn) GetInto(dst []byte) (out []byte, err error) {
+	out = dst
+	err = c.Get(func(b []byte) {
+		out = append(dst, b...)
+	})
+
+	return
+}
+
+// GetOwned will get a message into a pooled buffer, the message is owned by the caller until it is released
+func (c *conn) GetOwned() (o *Owned, err error) {
+	o = newOwned()
+	if o.b, err = c.GetInto(o.b[:0]); err != nil {
+		o.Release()
+		return nil, err
+	}
+
+	return
+}
+
+// GetMessage will get a message along with it's headers, messages sent without headers have nil Headers
+// Note: The headers may be retained, please do not use the body outside of the called function
+func (c *conn) GetMessage(fn func(Message)) (err error) {
+	return c.Get(func(b []byte) {
+		fn(Message{Headers: c.hdrs, Body: b})
+	})
+}
+
 // Put will put a message
+// Note: Messages larger than the maximum frame size are rejected with ErrFrameTooLarge, the connection remains connected
 func (c *conn) Put(b []byte) (err error) {
-	c.mux.Lock()
-	err = c.put(b)
-	c.mux.Unlock()
+	if uint64(len(b)) > c.opts.MaxFrameSize {
+		return ErrFrameTooLarge
+	}
+
+	c.wmux.Lock()
+	defer c.wmux.Unlock()
+
+	var nc net.Conn
+	if nc, err = c.netConn(); err != nil {
+		return
+	}
+
+	if _, err = c.put(nc, b); err != nil {
+		c.setIdle(nc)
+	}
+
+	return
+}
+
+// PutBatch will put multiple messages with as few writes as possible, messages are written in place without being copied
+// Note: Batched messages are not compressed
+func (c *conn) PutBatch(msgs [][]byte) (err error) {
+	for _, b := range msgs {
+		if uint64(len(b)) > c.opts.MaxFrameSize {
+			return ErrFrameTooLarge
+		}
+	}
+
+	c.wmux.Lock()
+	defer c.wmux.Unlock()
+
+	var nc net.Conn
+	if nc, err = c.netConn(); err != nil {
+		return
+	}
+
+	if _, err = c.putBatch(nc, msgs); err != nil {
+		c.setIdle(nc)
+	}
+
+	return
+}
+
+// putBatch will write multiple data frames with a single writev
+// Note: n is the number of bytes written to nc
+func (c *conn) putBatch(nc net.Conn, msgs [][]byte) (n int, err error) {
+	// Headers and trailers are encoded into our batch buffer so each message can be referenced in place
+	const size = headerSize + checksumSize
+	if need := len(msgs) * size; cap(c.bbuf) < need {
+		c.bbuf = make([]byte, need)
+	}
+
+	if c.wbuf.Len() > 0 {
+		// Buffered frames go first
+		c.bufs = append(c.bufs, c.wbuf.Bytes())
+	}
+
+	for i, b := range msgs {
+		f := c.newFrame(frameData)
+		f.len = uint64(len(b))
+
+		meta := c.bbuf[i*size : (i+1)*size]
+		hn := encodeHeader(meta[:headerSize], f, c.wh.compact)
+		c.bufs = append(c.bufs, meta[:hn], b)
+
+		if f.flags&flagChecksum != 0 {
+			binary.LittleEndian.PutUint32(meta[headerSize:], checksum(meta[:hn], b))
+			c.bufs = append(c.bufs, meta[headerSize:])
+		}
+	}
+
+	return c.writev(nc)
+}
+
+// Flush will write any buffered messages, see Opts.FlushInterval
+func (c *conn) Flush() (err error) {
+	c.wmux.Lock()
+	defer c.wmux.Unlock()
+
+	var nc net.Conn
+	if nc, err = c.netConn(); err != nil {
+		return
+	}
+
+	if _, err = c.flush(nc); err != nil {
+		c.setIdle(nc)
+	}
+
 	return
 }
 
+// PutContext will put a message, the deadline and cancellation of ctx are applied to the write
+// Note: If ctx ends before any of the message has been written, the connection remains connected.
+// If ctx ends mid-message, or buffered messages ahead of it were discarded, the connection is set to idle as the stream can no longer be trusted
+func (c *conn) PutContext(ctx context.Context, b []byte) (err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+
+	if uint64(len(b)) > c.opts.MaxFrameSize {
+		return ErrFrameTooLarge
+	}
+
+	c.wmux.Lock()
+	defer c.wmux.Unlock()
+
+	var nc net.Conn
+	if nc, err = c.netConn(); err != nil {
+		return
+	}
+
+	return c.putContext(ctx, nc, c.newFrame(frameData), b)
+}
+
+// putContext will write a data frame, the deadline and cancellation of ctx are applied to the write
+// Note: This is expected to be called while the write lock is held
+func (c *conn) putContext(ctx context.Context, nc net.Conn, f frame, b []byte) (err error) {
+	// A failed write discards any frames buffered by earlier puts, only our own frame can be abandoned safely
+	buffered := c.wbuf.Len() > 0
+
+	var n int
+	end := watch(ctx, nc.SetWriteDeadline)
+	n, err = c.putFrame(nc, f, b)
+	end()
+
+	if err == nil {
+		return
+	}
+
+	var caused bool
+	if err, caused = contextErr(ctx, err); caused && n == 0 && !buffered {
+		// Nothing was written and nothing was lost, our connection is still in a valid state
+		return
+	}
+
+	c.setIdle(nc)
+	return
+}
+
+// PutMessage will put a message along with it's headers, messages without headers are put the same as Put
+// Note: Headers require the peer to support protocol version 6, otherwise ErrUnsupportedVersion is returned
+func (c *conn) PutMessage(m Message) (err error) {
+	if len(m.Headers) == 0 {
+		return c.Put(m.Body)
+	}
+
+	c.wmux.Lock()
+	defer c.wmux.Unlock()
+
+	var nc net.Conn
+	if nc, err = c.netConn(); err != nil {
+		return
+	}
+
+	var (
+		f frame
+		b []byte
+	)
+
+	if f, b, err = c.encodeMessage(m); err != nil {
+		return
+	}
+
+	if _, err = c.putFrame(nc, f, b); err != nil {
+		c.setIdle(nc)
+	}
+
+	return
+}
+
+// PutMessageContext will put a message along with it's headers, the deadline and cancellation of ctx are applied to the write
+// Note: Errors are handled the same as PutContext and PutMessage
+func (c *conn) PutMessageContext(ctx context.Context, m Message) (err error) {
+	if len(m.Headers) == 0 {
+		return c.PutContext(ctx, m.Body)
+	}
+
+	if err = ctx.Err(); err != nil {
+		return
+	}
+
+	c.wmux.Lock()
+	defer c.wmux.Unlock()
+
+	var nc net.Conn
+	if nc, err = c.netConn(); err != nil {
+		return
+	}
+
+	var (
+		f frame
+		b []byte
+	)
+
+	if f, b, err = c.encodeMessage(m); err != nil {
+		return
+	}
+
+	return c.putContext(ctx, nc, f, b)
+}
+
+// encodeMessage will encode a message with headers into our message buffer and return it's data frame
+// Note: This is expected to be called while the write lock is held
+func (c *conn) encodeMessage(m Message) (f frame, b []byte, err error) {
+	if c.version < 6 {
+		err = ErrUnsupportedVersion
+		return
+	}
+
+	c.hbuf = append(AppendHeaders(c.hbuf[:0], m.Headers), m.Body...)
+	if uint64(len(c.hbuf)) > c.opts.MaxFrameSize {
+		err = ErrFrameTooLarge
+		return
+	}
+
+	f = c.newFrame(frameData)
+	f.flags |= flagHeaders
+	return f, c.hbuf, nil
+}
+
 // Close will close a connection
 func (c *conn) Close() (err error) {
 	if err = c.close(); err != nil {
@@ -269,9 +935,20 @@ func (c *conn) Close() (err error) {
 		return
 	}
 
-	// Call onDisconnect before we close the net.Conn
-	c.onDisconnect()
+	// Call onDisconnect before we close the net.Conn, unless a dead peer has already triggered them
+	if c.disconnected() {
+		c.onDisconnect()
+	}
+
+	c.mux.RLock()
+	nc := c.nc
+	c.mux.RUnlock()
+
+	if nc != nil {
+		c.putClose(nc)
+	}
 
+	// Note: We do not acquire rmux, closing the net.Conn will unblock any pending Get
 	c.mux.Lock()
 	if c.nc != nil {
 		// Close net.Conn
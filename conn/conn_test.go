@@ -1,8 +1,14 @@
 package conn
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net"
+	"strconv"
 	"sync"
 	"testing"
 	"time"
@@ -11,6 +17,7 @@ import (
 	"github.com/go-mangos/mangos"
 	mpair "github.com/go-mangos/mangos/protocol/pair"
 	mtcp "github.com/go-mangos/mangos/transport/tcp"
+	"github.com/missionMeteora/toolkit/errors"
 )
 
 var (
@@ -136,6 +143,105 @@ func TestBuffer(t *testing.T) {
 	}
 }
 
+func TestGetContext(t *testing.T) {
+	s, c := testPair(t)
+	defer s.Close()
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*20)
+	defer cancel()
+
+	if err := c.GetContext(ctx, nil); err != context.DeadlineExceeded {
+		t.Fatalf("invalid error, expected %v and received %v", context.DeadlineExceeded, err)
+	}
+
+	// Nothing was read, so our connection should still be usable
+	if err := s.Put(testVal); err != nil {
+		t.Fatal(err)
+	}
+
+	if msg, err := c.GetStr(); err != nil {
+		t.Fatal(err)
+	} else if msg != string(testVal) {
+		t.Fatalf("invalid message, expected '%s' and received '%s'", testVal, msg)
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	time.AfterFunc(time.Millisecond*20, cancel)
+
+	if err := c.GetContext(ctx, nil); err != context.Canceled {
+		t.Fatalf("invalid error, expected %v and received %v", context.Canceled, err)
+	}
+
+	if err := c.PutContext(ctx, testVal); err != context.Canceled {
+		t.Fatalf("invalid error, expected %v and received %v", context.Canceled, err)
+	}
+
+	if err := c.PutContext(context.Background(), testVal); err != nil {
+		t.Fatal(err)
+	}
+
+	if msg, err := s.GetStr(); err != nil {
+		t.Fatal(err)
+	} else if msg != string(testVal) {
+		t.Fatalf("invalid message, expected '%s' and received '%s'", testVal, msg)
+	}
+}
+
+func TestGetContextMidMessage(t *testing.T) {
+	var (
+		l   net.Listener
+		nc  net.Conn
+		err error
+	)
+
+	if l, err = net.Listen("tcp", "127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	go func() {
+		rc, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			return
+		}
+
+		if _, _, err = exchange(context.Background(), rc, nil); err != nil {
+			return
+		}
+
+		// Write a header for an 11 byte message, but only send part of the body
+		h := header{compact: true}
+		h.Write(rc, frame{typ: frameData, len: uint64(len(testVal))})
+		rc.Write(testVal[:4])
+		time.Sleep(time.Millisecond * 100)
+		rc.Close()
+	}()
+
+	if nc, err = l.Accept(); err != nil {
+		t.Fatal(err)
+	}
+
+	c := New()
+	defer c.Close()
+
+	if err = c.Connect(nc); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*20)
+	defer cancel()
+
+	if err = c.GetContext(ctx, nil); err != context.DeadlineExceeded {
+		t.Fatalf("invalid error, expected %v and received %v", context.DeadlineExceeded, err)
+	}
+
+	// We were interrupted mid-message, our connection should now be idle
+	if err = c.Get(nil); err != ErrIsIdle {
+		t.Fatalf("invalid error, expected %v and received %v", ErrIsIdle, err)
+	}
+}
+
 func BenchmarkMQ_32B(b *testing.B) {
 	benchmarkMQ(b, make([]byte, 32))
 }
@@ -176,6 +282,22 @@ func BenchmarkMQ_1MB(b *testing.B) {
 	benchmarkMQ(b, make([]byte, 1024*1024))
 }
 
+func BenchmarkMQUnbuffered_32B(b *testing.B) {
+	benchmarkMQWithOpts(b, Opts{ReadBufferSize: -1}, make([]byte, 32))
+}
+
+func BenchmarkMQUnbuffered_128B(b *testing.B) {
+	benchmarkMQWithOpts(b, Opts{ReadBufferSize: -1}, make([]byte, 128))
+}
+
+func BenchmarkMQUnbuffered_1KB(b *testing.B) {
+	benchmarkMQWithOpts(b, Opts{ReadBufferSize: -1}, make([]byte, 1024))
+}
+
+func BenchmarkMQUnbuffered_4KB(b *testing.B) {
+	benchmarkMQWithOpts(b, Opts{ReadBufferSize: -1}, make([]byte, 1024*4))
+}
+
 func BenchmarkMangos_32B(b *testing.B) {
 	benchmarkMangos(b, make([]byte, 32))
 }
@@ -217,9 +339,13 @@ func BenchmarkMangos_1MB(b *testing.B) {
 }
 
 func benchmarkMQ(b *testing.B, val []byte) {
+	benchmarkMQWithOpts(b, Opts{}, val)
+}
+
+func benchmarkMQWithOpts(b *testing.B, opts Opts, val []byte) {
 	var (
-		s = New()
-		c = New()
+		s = NewWithOpts(opts)
+		c = NewWithOpts(opts)
 
 		ready = make(chan struct{}, 1)
 
@@ -300,6 +426,52 @@ func benchmarkMQ(b *testing.B, val []byte) {
 	l.Close()
 }
 
+// testPair will return a connected pair of connections
+func testPair(t *testing.T) (s, c Conn) {
+	s = New()
+	c = New()
+	connectPair(t, s, c)
+	return
+}
+
+// connectPair will connect a pair of connections over tcp
+func connectPair(t *testing.T, s, c Conn) {
+	var (
+		l   net.Listener
+		nc  net.Conn
+		err error
+	)
+
+	if l, err = net.Listen("tcp", "127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	done := make(chan error, 1)
+
+	go func() {
+		nc, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			done <- err
+			return
+		}
+
+		done <- c.Connect(nc)
+	}()
+
+	if nc, err = l.Accept(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = s.Connect(nc); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
 func benchmarkMangos(b *testing.B, val []byte) {
 	var (
 		s  mangos.Socket
@@ -359,3 +531,1037 @@ func benchmarkMangos(b *testing.B, val []byte) {
 	s.Close()
 	c.Close()
 }
+
+func TestHeartbeat(t *testing.T) {
+	var (
+		opts = Opts{Heartbeat: time.Millisecond * 10, HeartbeatMisses: 3}
+		dc   = make(chan struct{}, 2)
+		err  error
+	)
+
+	onDC := func(Conn) { dc <- struct{}{} }
+
+	// Our responsive peer does not have heartbeats enabled, it answers pings while it is reading
+	s := NewWithOpts(opts).OnDisconnect(onDC)
+	c := New()
+	connectPair(t, s, c)
+
+	msgs := make(chan string, 1)
+	go func() {
+		for c.Get(func(b []byte) { msgs <- string(b) }) == nil {
+		}
+	}()
+
+	// Pongs are received by Get, so our heartbeat side must be reading as well
+	go func() {
+		for s.Get(nil) == nil {
+		}
+	}()
+
+	time.Sleep(time.Millisecond * 100)
+
+	if err = s.Put(testVal); err != nil {
+		t.Fatal(err)
+	}
+
+	if msg := <-msgs; msg != string(testVal) {
+		t.Fatalf("invalid message, expected %s and received %s", testVal, msg)
+	}
+
+	select {
+	case <-dc:
+		t.Fatal("responsive peer was considered dead")
+	default:
+	}
+
+	s.Close()
+	c.Close()
+	<-dc
+
+	// Our unresponsive peer never reads, so it never answers our pings
+	s = NewWithOpts(opts).OnDisconnect(onDC)
+	c = New()
+	connectPair(t, s, c)
+	defer c.Close()
+
+	go func() {
+		for s.Get(nil) == nil {
+		}
+	}()
+
+	select {
+	case <-dc:
+	case <-time.After(time.Second):
+		t.Fatal("dead peer was not detected")
+	}
+
+	if err = s.Put(testVal); err != ErrIsIdle {
+		t.Fatalf("invalid error, expected %v and received %v", ErrIsIdle, err)
+	}
+
+	// OnDisconnect funcs have already been called, closing should not call them again
+	s.Close()
+
+	select {
+	case <-dc:
+		t.Fatal("OnDisconnect funcs were called twice")
+	default:
+	}
+}
+
+func TestHeartbeatSlowFrame(t *testing.T) {
+	c, rc, err := rawPair(t, Opts{Heartbeat: time.Millisecond * 20, HeartbeatMisses: 3}, []byte{'m', 'q', 4, 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	defer c.Close()
+
+	// Our payload arrives a byte at a time, taking far longer than the allowed misses to complete
+	payload := bytes.Repeat([]byte{'a'}, 32)
+	go func() {
+		rc.Write([]byte{frameData, 0, byte(len(payload)), 0, 0, 0, 0, 0, 0, 0})
+		for _, b := range payload {
+			time.Sleep(time.Millisecond * 5)
+			rc.Write([]byte{b})
+		}
+	}()
+
+	if err = c.Get(func(b []byte) {
+		if !bytes.Equal(b, payload) {
+			t.Errorf("invalid message, expected %s and received %s", payload, b)
+		}
+	}); err != nil {
+		t.Fatalf("peer sending a slow frame was considered dead: %v", err)
+	}
+}
+
+// rawPair will return a connection connected to a raw net.Conn, hs is written by the raw side as it's handshake
+func rawPair(t *testing.T, opts Opts, hs []byte) (c Conn, rc net.Conn, err error) {
+	var l net.Listener
+	if l, err = net.Listen("tcp", "127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	if rc, err = net.Dial("tcp", l.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+
+	rc.Write(hs)
+
+	var nc net.Conn
+	if nc, err = l.Accept(); err != nil {
+		t.Fatal(err)
+	}
+
+	c = NewWithOpts(opts)
+	err = c.Connect(nc)
+
+	// Read our handshake from the raw side, codecs are only sent once version 2 or later is negotiated
+	io.ReadFull(rc, make([]byte, 3))
+	if err == nil && c.Version() >= 2 {
+		readCodecIDs(rc)
+	}
+
+	return
+}
+
+func TestHandshake(t *testing.T) {
+	c, rc, err := rawPair(t, Opts{}, []byte{'m', 'q', 9, 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Newer peers should be negotiated down to our version
+	if v := c.Version(); v != ProtocolVersion {
+		t.Fatalf("invalid version, expected %d and received %d", ProtocolVersion, v)
+	}
+
+	c.Close()
+	rc.Close()
+
+	// Version 1 peers do not send codecs
+	if c, rc, err = rawPair(t, Opts{}, []byte{'m', 'q', 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	if v := c.Version(); v != 1 {
+		t.Fatalf("invalid version, expected %d and received %d", 1, v)
+	}
+
+	c.Close()
+	rc.Close()
+
+	if c, rc, err = rawPair(t, Opts{}, []byte("GET / HTTP/1.1\r\n")); err != ErrInvalidHandshake {
+		t.Fatalf("invalid error, expected %v and received %v", ErrInvalidHandshake, err)
+	}
+
+	c.Close()
+	rc.Close()
+
+	if c, rc, err = rawPair(t, Opts{}, []byte{'m', 'q', 0}); err != ErrUnsupportedVersion {
+		t.Fatalf("invalid error, expected %v and received %v", ErrUnsupportedVersion, err)
+	}
+
+	c.Close()
+	rc.Close()
+}
+
+func TestConnectContext(t *testing.T) {
+	// Our peer never sends it's handshake
+	a, b := net.Pipe()
+	defer b.Close()
+
+	go io.Copy(ioutil.Discard, b)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(time.Millisecond*20, cancel)
+
+	c := New()
+	done := make(chan error, 1)
+	go func() {
+		done <- c.ConnectContext(ctx, a)
+	}()
+
+	select {
+	case err := <-done:
+		if err != context.Canceled {
+			t.Fatalf("invalid error, expected %v and received %v", context.Canceled, err)
+		}
+
+	case <-time.After(time.Second):
+		t.Fatal("canceling did not abort the handshake")
+	}
+
+	// Our connection should be idle, ready to connect again
+	if err := c.Put(testVal); err != ErrIsIdle {
+		t.Fatalf("invalid error, expected %v and received %v", ErrIsIdle, err)
+	}
+}
+
+func TestHandshakeV1(t *testing.T) {
+	// Codecs and checksums must not be used with version 1 peers
+	c, rc, err := rawPair(t, Opts{Codecs: []Codec{Flate}, Checksums: true}, []byte{'m', 'q', 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	defer rc.Close()
+
+	go c.Put(testVal)
+
+	// Version 1 frames are [type][flags][little-endian uint64 length][payload]
+	b := make([]byte, headerSize+len(testVal))
+	if _, err = io.ReadFull(rc, b); err != nil {
+		t.Fatal(err)
+	}
+
+	if b[0] != frameData || b[1] != 0 || binary.LittleEndian.Uint64(b[2:]) != uint64(len(testVal)) || !bytes.Equal(b[headerSize:], testVal) {
+		t.Fatalf("invalid version 1 frame, received %v", b)
+	}
+
+	b = make([]byte, headerSize)
+	binary.LittleEndian.PutUint64(b[2:], uint64(len(testVal)))
+	rc.Write(append(b, testVal...))
+
+	if str, err := c.GetStr(); err != nil || str != string(testVal) {
+		t.Fatalf("invalid message, expected %s and received %s (%v)", testVal, str, err)
+	}
+}
+
+func TestControlFrames(t *testing.T) {
+	c, rc, err := rawPair(t, Opts{}, []byte{'m', 'q', 4, 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	defer rc.Close()
+
+	var h header
+	go func() {
+		// An unknown control frame with a payload, followed by a ping and a message
+		h.Write(rc, frame{typ: 42, len: 4})
+		rc.Write([]byte("skip"))
+		h.Write(rc, frame{typ: framePing})
+		h.Write(rc, frame{typ: frameData, len: uint64(len(testVal))})
+		rc.Write(testVal)
+	}()
+
+	// Only our data frame should be surfaced
+	var msg string
+	if msg, err = c.GetStr(); err != nil {
+		t.Fatal(err)
+	} else if msg != string(testVal) {
+		t.Fatalf("invalid message, expected '%s' and received '%s'", testVal, msg)
+	}
+
+	// Our ping should have been answered
+	var (
+		rh header
+		f  frame
+	)
+
+	if f, _, err = rh.Read(rc); err != nil {
+		t.Fatal(err)
+	} else if f.typ != framePong {
+		t.Fatalf("invalid frame type, expected %d and received %d", framePong, f.typ)
+	}
+
+	rh.Write(rc, frame{typ: frameClose})
+	if err = c.Get(nil); err != ErrPeerClosed {
+		t.Fatalf("invalid error, expected %v and received %v", ErrPeerClosed, err)
+	}
+}
+
+func TestMaxFrameSize(t *testing.T) {
+	c, rc, err := rawPair(t, Opts{MaxFrameSize: 16}, []byte{'m', 'q', 4, 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	defer rc.Close()
+
+	// Oversized puts are rejected without affecting the connection
+	if err = c.Put(make([]byte, 17)); err != ErrFrameTooLarge {
+		t.Fatalf("invalid error, expected %v and received %v", ErrFrameTooLarge, err)
+	}
+
+	if err = c.Put(testVal); err != nil {
+		t.Fatal(err)
+	}
+
+	// Our peer claims an enormous frame, this should be rejected before allocating
+	var h header
+	h.Write(rc, frame{typ: frameData, len: 1 << 62})
+
+	if err = c.Get(nil); err != ErrFrameTooLarge {
+		t.Fatalf("invalid error, expected %v and received %v", ErrFrameTooLarge, err)
+	}
+
+	if err = c.Get(nil); err != ErrIsIdle {
+		t.Fatalf("invalid error, expected %v and received %v", ErrIsIdle, err)
+	}
+}
+
+func TestCompression(t *testing.T) {
+	var (
+		large = bytes.Repeat([]byte("compressible "), 1024)
+		err   error
+	)
+
+	// Our peers prefer different codecs, but have one in common
+	s := NewWithOpts(Opts{Codecs: []Codec{Gzip, Flate}})
+	c := NewWithOpts(Opts{Codecs: []Codec{Flate}})
+	connectPair(t, s, c)
+	defer s.Close()
+	defer c.Close()
+
+	for _, msg := range [][]byte{large, testVal, large} {
+		go s.Put(msg)
+
+		var recv []byte
+		if err = c.Get(func(b []byte) { recv = append(recv[:0], b...) }); err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(recv, msg) {
+			t.Fatalf("invalid message, expected %d bytes and received %d bytes", len(msg), len(recv))
+		}
+	}
+}
+
+func TestCompressionFrames(t *testing.T) {
+	var (
+		large = bytes.Repeat([]byte("compressible "), 1024)
+		rh    header
+		f     frame
+	)
+
+	// Our raw peer supports flate
+	c, rc, err := rawPair(t, Opts{Codecs: []Codec{Gzip, Flate}, MaxFrameSize: uint64(len(large))}, []byte{'m', 'q', 4, 1, Flate.ID()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	defer rc.Close()
+
+	// Large messages should be compressed, small messages should not
+	go func() {
+		c.Put(large)
+		c.Put(testVal)
+	}()
+
+	if f, _, err = rh.Read(rc); err != nil {
+		t.Fatal(err)
+	}
+
+	if f.flags&flagCompressed == 0 || f.len >= uint64(len(large)) {
+		t.Fatalf("expected a compressed frame, received flags %d and length %d", f.flags, f.len)
+	}
+
+	body := make([]byte, f.len)
+	if _, err = io.ReadFull(rc, body); err != nil {
+		t.Fatal(err)
+	}
+
+	var out []byte
+	if out, err = Flate.Decode(nil, body, uint64(len(large))); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(out, large) {
+		t.Fatal("invalid decompressed message")
+	}
+
+	if f, _, err = rh.Read(rc); err != nil {
+		t.Fatal(err)
+	}
+
+	if f.flags&flagCompressed != 0 || f.len != uint64(len(testVal)) {
+		t.Fatalf("expected an uncompressed frame, received flags %d and length %d", f.flags, f.len)
+	}
+
+	io.ReadFull(rc, make([]byte, f.len))
+
+	// Compressed frames which expand beyond our maximum frame size should be rejected
+	if body, err = Flate.Encode(nil, append(large, large...)); err != nil {
+		t.Fatal(err)
+	}
+
+	rh.Write(rc, frame{typ: frameData, flags: flagCompressed, len: uint64(len(body))})
+	rc.Write(body)
+
+	if err = c.Get(nil); err != ErrFrameTooLarge {
+		t.Fatalf("invalid error, expected %v and received %v", ErrFrameTooLarge, err)
+	}
+}
+
+func TestChecksums(t *testing.T) {
+	var (
+		rh  header
+		f   frame
+		sum [checksumSize]byte
+	)
+
+	c, rc, err := rawPair(t, Opts{Checksums: true}, []byte{'m', 'q', 4, 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	defer rc.Close()
+
+	go c.Put(testVal)
+
+	// Our frame should include a valid checksum trailer
+	if f, _, err = rh.Read(rc); err != nil {
+		t.Fatal(err)
+	} else if f.flags&flagChecksum == 0 {
+		t.Fatal("expected a checksummed frame")
+	}
+
+	body := make([]byte, f.len)
+	io.ReadFull(rc, body)
+	io.ReadFull(rc, sum[:])
+
+	if binary.LittleEndian.Uint32(sum[:]) != checksum(rh.Bytes(), body) {
+		t.Fatal("invalid checksum")
+	}
+
+	// A valid checksummed frame from our peer should be accepted
+	f = frame{typ: frameData, flags: flagChecksum, len: uint64(len(testVal))}
+	rh.Write(rc, f)
+	rc.Write(testVal)
+	binary.LittleEndian.PutUint32(sum[:], checksum(rh.Bytes(), testVal))
+	rc.Write(sum[:])
+
+	var msg string
+	if msg, err = c.GetStr(); err != nil {
+		t.Fatal(err)
+	} else if msg != string(testVal) {
+		t.Fatalf("invalid message, expected '%s' and received '%s'", testVal, msg)
+	}
+
+	// A corrupted frame should tear down the connection
+	rh.Write(rc, f)
+	rc.Write([]byte("hello wormd"))
+	rc.Write(sum[:])
+
+	if err = c.Get(nil); err != ErrChecksumMismatch {
+		t.Fatalf("invalid error, expected %v and received %v", ErrChecksumMismatch, err)
+	}
+
+	if err = c.Get(nil); err != ErrIsIdle {
+		t.Fatalf("invalid error, expected %v and received %v", ErrIsIdle, err)
+	}
+
+	// Older peers cannot verify checksums, so none should be sent
+	if c, rc, err = rawPair(t, Opts{Checksums: true}, []byte{'m', 'q', 2, 0}); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	defer rc.Close()
+
+	go c.Put(testVal)
+
+	if f, _, err = rh.Read(rc); err != nil {
+		t.Fatal(err)
+	} else if f.flags&flagChecksum != 0 {
+		t.Fatal("expected a frame without a checksum")
+	}
+}
+
+func TestChecksumsPair(t *testing.T) {
+	s := NewWithOpts(Opts{Checksums: true, Codecs: []Codec{Flate}})
+	c := NewWithOpts(Opts{Checksums: true, Codecs: []Codec{Flate}})
+	connectPair(t, s, c)
+	defer s.Close()
+	defer c.Close()
+
+	large := bytes.Repeat(testVal, 1024*8)
+	for _, msg := range [][]byte{testVal, large} {
+		go s.Put(msg)
+
+		var recv []byte
+		if err := c.Get(func(b []byte) { recv = append(recv[:0], b...) }); err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(recv, msg) {
+			t.Fatalf("invalid message, expected %d bytes and received %d bytes", len(msg), len(recv))
+		}
+	}
+}
+
+func TestStream(t *testing.T) {
+	s, c := testPair(t)
+	defer s.Close()
+	defer c.Close()
+
+	msg := make([]byte, 1024*1024+7)
+	rand.Read(msg)
+
+	// Known and unknown sizes should both be streamed and received in full
+	for _, size := range []int64{int64(len(msg)), -1} {
+		done := make(chan error, 1)
+		go func(size int64) {
+			done <- s.PutReader(bytes.NewReader(msg), size)
+		}(size)
+
+		var recv bytes.Buffer
+		if err := c.GetReader(func(r io.Reader) (err error) {
+			_, err = io.Copy(&recv, r)
+			return
+		}); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(recv.Bytes(), msg) {
+			t.Fatalf("invalid message, expected %d bytes and received %d bytes", len(msg), recv.Len())
+		}
+	}
+
+	// Chunked messages should be assembled for Get, and partially read messages should be discarded by GetReader
+	go func() {
+		s.PutReader(bytes.NewReader(msg), -1)
+		s.PutReader(bytes.NewReader(msg), -1)
+		s.Put(testVal)
+	}()
+
+	if err := c.Get(func(b []byte) {
+		if !bytes.Equal(b, msg) {
+			t.Errorf("invalid message, expected %d bytes and received %d bytes", len(msg), len(b))
+		}
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.GetReader(func(r io.Reader) error {
+		_, err := r.Read(make([]byte, 16))
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if str, err := c.GetStr(); err != nil {
+		t.Fatal(err)
+	} else if str != string(testVal) {
+		t.Fatalf("invalid message, expected '%s' and received '%s'", testVal, str)
+	}
+}
+
+func TestStreamShortRead(t *testing.T) {
+	s, c := testPair(t)
+	defer s.Close()
+	defer c.Close()
+
+	// Nothing has been written yet, so our connection should remain connected
+	if err := s.PutReader(bytes.NewReader(testVal), 64); err != io.ErrUnexpectedEOF {
+		t.Fatalf("invalid error, expected %v and received %v", io.ErrUnexpectedEOF, err)
+	}
+
+	go c.Get(nil)
+
+	if err := s.Put(testVal); err != nil {
+		t.Fatal(err)
+	}
+
+	// Part of the message has been written, so our connection cannot be trusted
+	go func() {
+		for c.Get(nil) == nil {
+		}
+	}()
+
+	if err := s.PutReader(bytes.NewReader(make([]byte, streamChunkSize*2)), streamChunkSize*3); err != io.ErrUnexpectedEOF {
+		t.Fatalf("invalid error, expected %v and received %v", io.ErrUnexpectedEOF, err)
+	}
+
+	if err := s.Put(testVal); err != ErrIsIdle {
+		t.Fatalf("invalid error, expected %v and received %v", ErrIsIdle, err)
+	}
+
+	// Older peers cannot receive streams
+	old, rc, err := rawPair(t, Opts{}, []byte{'m', 'q', 3, 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer old.Close()
+	defer rc.Close()
+
+	if err = old.PutReader(bytes.NewReader(testVal), -1); err != ErrUnsupportedVersion {
+		t.Fatalf("invalid error, expected %v and received %v", ErrUnsupportedVersion, err)
+	}
+}
+
+func TestGetInto(t *testing.T) {
+	s, c := testPair(t)
+	defer s.Close()
+	defer c.Close()
+
+	go func() {
+		s.Put([]byte("foo"))
+		s.Put([]byte("bar"))
+	}()
+
+	var (
+		a, b []byte
+		err  error
+	)
+
+	if a, err = c.GetInto(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// Our first message should be unaffected by subsequent reads
+	if b, err = c.GetInto(make([]byte, 0, 8)); err != nil {
+		t.Fatal(err)
+	}
+
+	if string(a) != "foo" || string(b) != "bar" {
+		t.Fatalf("invalid messages, expected foo and bar and received %s and %s", a, b)
+	}
+}
+
+func TestGetOwned(t *testing.T) {
+	s, c := testPair(t)
+	defer s.Close()
+	defer c.Close()
+
+	go func() {
+		s.Put([]byte("foo"))
+		s.Put([]byte("bar"))
+	}()
+
+	a, err := c.GetOwned()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := c.GetOwned()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(a.Bytes()) != "foo" || string(b.Bytes()) != "bar" {
+		t.Fatalf("invalid messages, expected foo and bar and received %s and %s", a.Bytes(), b.Bytes())
+	}
+
+	a.Release()
+	b.Release()
+
+	// Failed gets should not return a message
+	c.Close()
+	if o, err := c.GetOwned(); err != errors.ErrIsClosed || o != nil {
+		t.Fatalf("invalid result, expected %v and received %v (%v)", errors.ErrIsClosed, err, o)
+	}
+}
+
+func TestBuffered(t *testing.T) {
+	s := NewWithOpts(Opts{FlushInterval: time.Millisecond * 10, FlushSize: 64})
+	c := New()
+	connectPair(t, s, c)
+	defer s.Close()
+	defer c.Close()
+
+	recv := func() string {
+		str, err := c.GetStr()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return str
+	}
+
+	// Our message should be written once the flush interval has elapsed
+	if err := s.Put([]byte("interval")); err != nil {
+		t.Fatal(err)
+	}
+
+	if str := recv(); str != "interval" {
+		t.Fatalf("invalid message, expected interval and received %s", str)
+	}
+
+	// Our messages should be written once our flush size is reached
+	msg := bytes.Repeat([]byte("a"), 32)
+	for i := 0; i < 2; i++ {
+		if err := s.Put(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i := 0; i < 2; i++ {
+		if str := recv(); str != string(msg) {
+			t.Fatalf("invalid message, expected %s and received %s", msg, str)
+		}
+	}
+
+	// Our message should be written when flushed, as well as ahead of a large message
+	large := bytes.Repeat(testVal, 1024*8)
+	go func() {
+		s.Put([]byte("flushed"))
+		s.Flush()
+		s.Put([]byte("small"))
+		s.Put(large)
+	}()
+
+	for _, exp := range []string{"flushed", "small", string(large)} {
+		if str := recv(); str != exp {
+			t.Fatalf("invalid message, expected %d bytes and received %d bytes", len(exp), len(str))
+		}
+	}
+}
+
+func TestBufferedPutContext(t *testing.T) {
+	s := NewWithOpts(Opts{FlushInterval: time.Second})
+	c := New()
+
+	// Pipes are unbuffered, so nothing can be written while our peer is not reading
+	a, b := net.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		done <- c.Connect(b)
+	}()
+
+	if err := s.Connect(a); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	defer s.Close()
+	defer c.Close()
+
+	if err := s.Put([]byte("first")); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*20)
+	defer cancel()
+
+	// Our large message flushes the buffered message ahead of it, neither can be written
+	if err := s.PutContext(ctx, bytes.Repeat(testVal, 1024*8)); err != context.DeadlineExceeded {
+		t.Fatalf("invalid error, expected %v and received %v", context.DeadlineExceeded, err)
+	}
+
+	// Our buffered message was lost, so our connection can no longer be trusted
+	if err := s.Put([]byte("third")); err != ErrIsIdle {
+		t.Fatalf("invalid error, expected %v and received %v", ErrIsIdle, err)
+	}
+}
+
+func TestPutBatch(t *testing.T) {
+	s := NewWithOpts(Opts{Checksums: true, FlushInterval: time.Second})
+	c := NewWithOpts(Opts{Checksums: true})
+	connectPair(t, s, c)
+	defer s.Close()
+	defer c.Close()
+
+	large := bytes.Repeat(testVal, 1024*8)
+	msgs := [][]byte{[]byte("foo"), large, []byte("bar"), testVal}
+
+	go func() {
+		// Our buffered message should be written ahead of our batch
+		s.Put([]byte("buffered"))
+		s.PutBatch(msgs)
+	}()
+
+	for _, exp := range append([][]byte{[]byte("buffered")}, msgs...) {
+		var recv []byte
+		if err := c.Get(func(b []byte) { recv = append(recv[:0], b...) }); err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(recv, exp) {
+			t.Fatalf("invalid message, expected %d bytes and received %d bytes", len(exp), len(recv))
+		}
+	}
+
+	if err := s.PutBatch([][]byte{make([]byte, DefaultMaxFrameSize+1)}); err != ErrFrameTooLarge {
+		t.Fatalf("invalid error, expected %v and received %v", ErrFrameTooLarge, err)
+	}
+}
+
+func TestReadAhead(t *testing.T) {
+	for _, size := range []int{-1, 16, DefaultReadBufferSize} {
+		s := New()
+		c := NewWithOpts(Opts{ReadBufferSize: size, Checksums: true})
+		connectPair(t, s, c)
+
+		// Small frames are read together, large frames are read past the buffer
+		large := bytes.Repeat(testVal, 1024*8)
+		msgs := [][]byte{[]byte("foo"), []byte("bar"), large, []byte("baz")}
+		go s.PutBatch(msgs)
+
+		for _, exp := range msgs {
+			var recv []byte
+			if err := c.Get(func(b []byte) { recv = append(recv[:0], b...) }); err != nil {
+				t.Fatal(err)
+			}
+
+			if !bytes.Equal(recv, exp) {
+				t.Fatalf("invalid message with a read buffer of %d, expected %d bytes and received %d bytes", size, len(exp), len(recv))
+			}
+		}
+
+		s.Close()
+		c.Close()
+	}
+}
+
+func TestFullDuplex(t *testing.T) {
+	s, c := testPair(t)
+	defer s.Close()
+	defer c.Close()
+
+	// A pending Get must not block a Put on the same connection
+	recv := make(chan string, 1)
+	go func() {
+		str, _ := c.GetStr()
+		recv <- str
+	}()
+
+	time.Sleep(time.Millisecond * 10)
+	if err := c.Put([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+
+	if str, err := s.GetStr(); err != nil || str != "ping" {
+		t.Fatalf("invalid message, expected ping and received %s (%v)", str, err)
+	}
+
+	if err := s.Put([]byte("pong")); err != nil {
+		t.Fatal(err)
+	}
+
+	if str := <-recv; str != "pong" {
+		t.Fatalf("invalid message, expected pong and received %s", str)
+	}
+
+	// Both sides read and write concurrently
+	const n = 1000
+	var wg sync.WaitGroup
+	errs := make(chan error, 4)
+	for _, cc := range []Conn{s, c} {
+		wg.Add(2)
+		go func(cc Conn) {
+			defer wg.Done()
+			for i := 0; i < n; i++ {
+				if err := cc.Put([]byte(strconv.Itoa(i))); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(cc)
+
+		go func(cc Conn) {
+			defer wg.Done()
+			for i := 0; i < n; i++ {
+				str, err := cc.GetStr()
+				if err != nil {
+					errs <- err
+					return
+				}
+
+				if str != strconv.Itoa(i) {
+					errs <- fmt.Errorf("invalid message, expected %d and received %s", i, str)
+					return
+				}
+			}
+		}(cc)
+	}
+
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+}
+
+func TestCompactHeaders(t *testing.T) {
+	// Each length should round trip using the smallest encoding
+	for _, tc := range []struct {
+		len  uint64
+		size int
+	}{{0, 3}, {255, 3}, {256, 4}, {1 << 16, 6}, {1 << 32, 10}} {
+		var (
+			buf bytes.Buffer
+			wh  = header{compact: true}
+			rh  = header{compact: true}
+		)
+
+		wh.Write(&buf, frame{typ: frameData, flags: flagChecksum | flagMore, len: tc.len})
+		if buf.Len() != tc.size {
+			t.Fatalf("invalid header size for %d, expected %d and received %d", tc.len, tc.size, buf.Len())
+		}
+
+		f, n, err := rh.Read(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if n != tc.size || f.len != tc.len || f.flags != flagChecksum|flagMore {
+			t.Fatalf("invalid frame for %d, received %+v from %d bytes", tc.len, f, n)
+		}
+	}
+
+	c, rc, err := rawPair(t, Opts{Checksums: true}, []byte{'m', 'q', ProtocolVersion, 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	defer rc.Close()
+
+	go c.Put(testVal)
+
+	// Our message should use a compact header, followed by it's payload and trailer
+	b := make([]byte, 3+len(testVal)+checksumSize)
+	if _, err = io.ReadFull(rc, b); err != nil {
+		t.Fatal(err)
+	}
+
+	if b[1] != flagChecksum || int(b[2]) != len(testVal) || !bytes.Equal(b[3:3+len(testVal)], testVal) {
+		t.Fatalf("invalid frame, received %v", b)
+	}
+
+	// Compact headers from our peer should be read
+	large := bytes.Repeat(testVal, 1024)
+	h := header{compact: true}
+	go func() {
+		for _, msg := range [][]byte{testVal, large} {
+			h.Write(rc, frame{typ: frameData, len: uint64(len(msg))})
+			rc.Write(msg)
+		}
+	}()
+
+	for _, exp := range [][]byte{testVal, large} {
+		var recv []byte
+		if err = c.Get(func(b []byte) { recv = append(recv[:0], b...) }); err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(recv, exp) {
+			t.Fatalf("invalid message, expected %d bytes and received %d bytes", len(exp), len(recv))
+		}
+	}
+}
+
+func TestMessages(t *testing.T) {
+	s, c := testPair(t)
+	defer s.Close()
+	defer c.Close()
+
+	hdrs := Headers{"content-type": "application/json", "trace-id": "abc123"}
+	go func() {
+		s.PutMessage(Message{Headers: hdrs, Body: testVal})
+		s.PutMessage(Message{Body: testVal})
+		s.PutMessage(Message{Headers: hdrs, Body: testVal})
+	}()
+
+	var m Message
+	if err := c.GetMessage(func(msg Message) {
+		m.Headers = msg.Headers
+		m.Body = append(m.Body[:0], msg.Body...)
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(m.Headers) != len(hdrs) || m.Headers["content-type"] != hdrs["content-type"] || m.Headers["trace-id"] != hdrs["trace-id"] {
+		t.Fatalf("invalid headers, expected %v and received %v", hdrs, m.Headers)
+	}
+
+	if !bytes.Equal(m.Body, testVal) {
+		t.Fatalf("invalid body, expected %s and received %s", testVal, m.Body)
+	}
+
+	// Messages without headers should not have any
+	if err := c.GetMessage(func(msg Message) { m.Headers = msg.Headers }); err != nil {
+		t.Fatal(err)
+	}
+
+	if m.Headers != nil {
+		t.Fatalf("invalid headers, expected none and received %v", m.Headers)
+	}
+
+	// Get should only provide the body
+	if str, err := c.GetStr(); err != nil || str != string(testVal) {
+		t.Fatalf("invalid message, expected %s and received %s (%v)", testVal, str, err)
+	}
+
+	// Older peers do not support headers
+	oc, rc, err := rawPair(t, Opts{}, []byte{'m', 'q', 5, 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer oc.Close()
+	defer rc.Close()
+
+	if err = oc.PutMessage(Message{Headers: hdrs, Body: testVal}); err != ErrUnsupportedVersion {
+		t.Fatalf("invalid error, expected %v and received %v", ErrUnsupportedVersion, err)
+	}
+}
+
+func TestHeaders(t *testing.T) {
+	hdrs := Headers{"a": "1", "": "empty key", "empty value": ""}
+	b := AppendHeaders(nil, hdrs)
+	b = append(b, "body"...)
+
+	h, rest, err := ReadHeaders(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(h) != len(hdrs) || h["a"] != "1" || h[""] != "empty key" || h["empty value"] != "" || string(rest) != "body" {
+		t.Fatalf("invalid headers, expected %v and received %v (%s)", hdrs, h, rest)
+	}
+
+	// Corrupt blocks should be rejected rather than allocating
+	for _, b := range [][]byte{nil, {0xff, 0xff, 0xff, 0xff, 0x0f}, {1, 5, 'a'}} {
+		if _, _, err = ReadHeaders(b); err != ErrInvalidHeaders {
+			t.Fatalf("invalid error for %v, expected %v and received %v", b, ErrInvalidHeaders, err)
+		}
+	}
+}
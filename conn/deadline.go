@@ -0,0 +1,78 @@
+package conn
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// aLongTimeAgo is a deadline in the past, used to interrupt blocked reads and writes
+var aLongTimeAgo = time.Unix(1, 0)
+
+// watch will apply the deadline and cancellation of ctx using set (e.g. net.Conn.SetReadDeadline)
+// Note: The returned func must be called once the action has completed, it will clear the deadline
+func watch(ctx context.Context, set func(time.Time) error) (end func()) {
+	if t, ok := ctx.Deadline(); ok {
+		set(t)
+	}
+
+	if ctx.Done() == nil {
+		// ctx can never be canceled, no need to watch it
+		return func() { set(time.Time{}) }
+	}
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		select {
+		case <-ctx.Done():
+			// Interrupt the pending action
+			set(aLongTimeAgo)
+		case <-stop:
+		}
+	}()
+
+	return func() {
+		close(stop)
+		<-done
+		set(time.Time{})
+	}
+}
+
+// isTimeout will return whether or not an error is a net.Conn timeout
+func isTimeout(err error) bool {
+	nerr, ok := err.(net.Error)
+	return ok && nerr.Timeout()
+}
+
+// handshakeErr will return the ctx error if err was caused by ctx ending, otherwise err is returned
+// Note: Our handshake deadline may be reached before ctx notices, so an expired ctx deadline is treated as exceeded
+func handshakeErr(ctx context.Context, err error) error {
+	if cerr := ctx.Err(); cerr != nil {
+		return cerr
+	}
+
+	if t, ok := ctx.Deadline(); ok && isTimeout(err) && !time.Now().Before(t) {
+		return context.DeadlineExceeded
+	}
+
+	return err
+}
+
+// contextErr will return the ctx error if err was caused by ctx, otherwise err is returned
+// Note: caused is true when err was a timeout triggered by the deadline or cancellation of ctx
+func contextErr(ctx context.Context, err error) (cerr error, caused bool) {
+	if err == nil || !isTimeout(err) {
+		return err, false
+	}
+
+	if cerr = ctx.Err(); cerr == nil {
+		// Our deadline was reached before the context noticed, treat it as exceeded
+		cerr = context.DeadlineExceeded
+	}
+
+	return cerr, true
+}
@@ -0,0 +1,376 @@
+package conn
+
+import (
+	"context"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"math"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/missionMeteora/toolkit/errors"
+)
+
+const (
+	// ErrInvalidHandshake is returned when a peer does not complete a valid handshake
+	ErrInvalidHandshake = errors.Error("invalid handshake")
+	// ErrUnsupportedVersion is returned when a peer only supports incompatible protocol versions
+	ErrUnsupportedVersion = errors.Error("unsupported protocol version")
+	// ErrFrameTooLarge is returned when a frame exceeds the maximum frame size
+	ErrFrameTooLarge = errors.Error("frame exceeds maximum frame size")
+	// ErrChecksumMismatch is returned when a frame fails checksum verification, the connection is set to idle
+	ErrChecksumMismatch = errors.Error("frame checksum mismatch")
+	// ErrInvalidFrame is returned when a peer sends a malformed frame
+	ErrInvalidFrame = errors.Error("invalid frame")
+	// ErrPeerClosed is returned when the peer has closed the connection
+	ErrPeerClosed = errors.Error("peer closed the connection")
+)
+
+const (
+	// ProtocolVersion is the latest protocol version supported
+	// Version 2 adds compression codecs to the handshake
+	// Version 3 adds frame checksums
+	// Version 4 adds chunked data frames
+	// Version 5 adds compact frame headers
+	// Version 6 adds message headers
+	ProtocolVersion = 6
+	// minProtocolVersion is the oldest protocol version supported
+	minProtocolVersion = 1
+
+	// handshakeTimeout is the time allowed for a peer to complete the handshake
+	handshakeTimeout = time.Second * 10
+	// closeTimeout is the time allowed to notify the peer that we are closing
+	closeTimeout = time.Millisecond * 100
+	// headerSize is the maximum size of a frame header
+	headerSize = 10
+	// checksumSize is the size of a frame checksum trailer
+	checksumSize = 4
+)
+
+// handshakeMagic prefixes the handshake, it identifies the peer as speaking our protocol
+var handshakeMagic = [2]byte{'m', 'q'}
+
+const (
+	// flagCompressed marks a data frame payload as compressed with the negotiated codec
+	flagCompressed byte = 1 << iota
+	// flagChecksum marks a frame as having a CRC32C trailer covering it's header and payload
+	flagChecksum
+	// flagMore marks a data frame as a chunk of a larger message, more chunks follow
+	// The final chunk of a message does not have flagMore set
+	flagMore
+)
+
+const (
+	// lenShift is the position of the compact length size within the frame flags
+	// The two bits select a little-endian length of 1, 2, 4 or 8 bytes
+	lenShift = 3
+	// lenMask masks the compact length size within the frame flags
+	lenMask byte = 3 << lenShift
+
+	// flagHeaders marks a data frame payload as beginning with a header block, see AppendHeaders
+	flagHeaders byte = 1 << 5
+)
+
+// castagnoli is the CRC32C table used for frame checksums
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+const (
+	// frameData is a user message, these are the only frames surfaced by Get
+	frameData byte = iota
+	// framePing is a control frame requesting a pong from the peer
+	framePing
+	// framePong is a control frame answering a ping
+	framePong
+	// frameClose is a control frame notifying the peer that we are closing the connection
+	frameClose
+)
+
+// frame is a frame header
+// Frame headers are encoded as [type][flags][little-endian uint64 length], followed by length bytes of payload
+// As of version 5, headers are compact and the length only uses as many bytes as the flags select (see lenMask)
+// Frames with flagChecksum are followed by a little-endian CRC32C trailer covering the encoded header and payload
+type frame struct {
+	typ   byte
+	flags byte
+	len   uint64
+}
+
+// isControl will return whether or not the frame is a control frame
+func (f frame) isControl() bool {
+	return f.typ != frameData
+}
+
+// header is a frame header encoder/decoder
+type header struct {
+	d [headerSize]byte
+	// Size of the most recently encoded or decoded header
+	n int
+	// Set when compact headers are negotiated
+	compact bool
+}
+
+// Write will write a frame header
+func (h *header) Write(w io.Writer, f frame) (n int, err error) {
+	h.n = encodeHeader(h.d[:], f, h.compact)
+	return w.Write(h.d[:h.n])
+}
+
+// Bytes will return the most recently encoded or decoded header
+func (h *header) Bytes() []byte {
+	return h.d[:h.n]
+}
+
+// encodeHeader will encode a frame header into dst and return it's size, dst must be at least headerSize bytes
+func encodeHeader(dst []byte, f frame, compact bool) (n int) {
+	dst[0] = f.typ
+	dst[1] = f.flags
+	if !compact {
+		binary.LittleEndian.PutUint64(dst[2:], f.len)
+		return headerSize
+	}
+
+	switch {
+	case f.len <= math.MaxUint8:
+		dst[2] = byte(f.len)
+		return 3
+	case f.len <= math.MaxUint16:
+		dst[1] |= 1 << lenShift
+		binary.LittleEndian.PutUint16(dst[2:], uint16(f.len))
+		return 4
+	case f.len <= math.MaxUint32:
+		dst[1] |= 2 << lenShift
+		binary.LittleEndian.PutUint32(dst[2:], uint32(f.len))
+		return 6
+	default:
+		dst[1] |= 3 << lenShift
+		binary.LittleEndian.PutUint64(dst[2:], f.len)
+		return headerSize
+	}
+}
+
+// Read will read a frame header
+func (h *header) Read(r io.Reader) (f frame, n int, err error) {
+	if !h.compact {
+		if n, err = io.ReadFull(r, h.d[:]); err != nil {
+			return
+		}
+
+		h.n = n
+		f.typ = h.d[0]
+		f.flags = h.d[1]
+		f.len = binary.LittleEndian.Uint64(h.d[2:])
+		return
+	}
+
+	// Compact headers are read in two parts, the flags determine the size of the length
+	if n, err = io.ReadFull(r, h.d[:2]); err != nil {
+		return
+	}
+
+	size := 1 << ((h.d[1] & lenMask) >> lenShift)
+	var ln int
+	ln, err = io.ReadFull(r, h.d[2:2+size])
+	if n += ln; err != nil {
+		return
+	}
+
+	h.n = n
+	f.typ = h.d[0]
+	f.flags = h.d[1] &^ lenMask
+	switch size {
+	case 1:
+		f.len = uint64(h.d[2])
+	case 2:
+		f.len = uint64(binary.LittleEndian.Uint16(h.d[2:]))
+	case 4:
+		f.len = uint64(binary.LittleEndian.Uint32(h.d[2:]))
+	default:
+		f.len = binary.LittleEndian.Uint64(h.d[2:])
+	}
+
+	return
+}
+
+// checksum will return the CRC32C of an encoded frame header and it's payload
+func checksum(hdr, b []byte) uint32 {
+	return crc32.Update(crc32.Checksum(hdr, castagnoli), castagnoli, b)
+}
+
+// verify will read the checksum trailer for the most recently read frame and verify it against the payload
+// Note: This is expected to be called while the read lock is held
+func (c *conn) verify(r io.Reader, b []byte) (n int, err error) {
+	if n, err = io.ReadFull(r, c.rsum[:]); err != nil {
+		return
+	}
+
+	if binary.LittleEndian.Uint32(c.rsum[:]) != checksum(c.rh.Bytes(), b) {
+		return n, ErrChecksumMismatch
+	}
+
+	return
+}
+
+// trailer will return the checksum trailer for the most recently written frame header, nil is returned if f has no checksum
+// Note: This is expected to be called while the write lock is held
+func (c *conn) trailer(f frame, b []byte) []byte {
+	if f.flags&flagChecksum == 0 {
+		return nil
+	}
+
+	binary.LittleEndian.PutUint32(c.wsum[:], checksum(c.wh.Bytes(), b))
+	return c.wsum[:]
+}
+
+// newFrame will return a frame header for a frame type, checksums are added when negotiated
+// Note: This is expected to be called while the write lock is held
+func (c *conn) newFrame(typ byte) (f frame) {
+	f.typ = typ
+	if c.sums {
+		f.flags |= flagChecksum
+	}
+
+	return
+}
+
+// exchange will exchange handshakes with our peer and return the negotiated protocol version along with the peer's codec IDs
+// Handshakes are encoded as [magic][version], both sides send theirs and use the lowest version
+// As of version 2, once both sides have read each other's version, [codec count][codec IDs] is exchanged
+// Note: Version 1 peers only read [magic][version], nothing further is sent to them
+// Note: The deadline and cancellation of ctx are applied to the exchange
+func exchange(ctx context.Context, nc net.Conn, codecs []Codec) (version byte, ids []byte, err error) {
+	end := watch(ctx, nc.SetDeadline)
+	defer end()
+
+	hello := []byte{handshakeMagic[0], handshakeMagic[1], ProtocolVersion}
+
+	var hs [3]byte
+	if err = swap(nc, hello, func() (err error) {
+		_, err = io.ReadFull(nc, hs[:])
+		return
+	}); err != nil {
+		return
+	}
+
+	if hs[0] != handshakeMagic[0] || hs[1] != handshakeMagic[1] {
+		return 0, nil, ErrInvalidHandshake
+	}
+
+	if version = hs[2]; version > ProtocolVersion {
+		version = ProtocolVersion
+	}
+
+	if version < minProtocolVersion {
+		return 0, nil, ErrUnsupportedVersion
+	}
+
+	if version < 2 {
+		// Version 1 peers do not exchange codecs
+		return
+	}
+
+	local := codecIDs(codecs)
+	err = swap(nc, append([]byte{byte(len(local))}, local...), func() (err error) {
+		ids, err = readCodecIDs(nc)
+		return
+	})
+
+	return
+}
+
+// swap will write out to nc while read is called
+// Writes are concurrent as some transports (e.g. net.Pipe) are unbuffered
+func swap(nc net.Conn, out []byte, read func() error) (err error) {
+	werr := make(chan error, 1)
+	go func() {
+		_, err := nc.Write(out)
+		werr <- err
+	}()
+
+	if err = read(); err != nil {
+		// Our write is ended by the handshake deadline or cancellation, or by the net.Conn closing
+		return
+	}
+
+	return <-werr
+}
+
+// readCodecIDs will read the codec IDs from a handshake
+func readCodecIDs(r io.Reader) (ids []byte, err error) {
+	var n [1]byte
+	if _, err = io.ReadFull(r, n[:]); err != nil {
+		return
+	}
+
+	ids = make([]byte, n[0])
+	_, err = io.ReadFull(r, ids)
+	return
+}
+
+// control will handle a control frame, the payload has already been read
+// Note: This is expected to be called while the read lock is held
+func (c *conn) control(nc net.Conn, f frame) (err error) {
+	switch f.typ {
+	case framePing:
+		c.ping(nc)
+	case framePong:
+		// Any frame from our peer updates our last seen time, no further handling is needed
+	case frameClose:
+		return ErrPeerClosed
+	}
+
+	// Unknown control frames are ignored so newer peers can introduce them
+	return
+}
+
+// queueControl will queue a ping or pong and write it from a separate goroutine
+// This ensures a blocked Put cannot stall our reads or dead peer detection
+// Note: q is the queued flag for the frame type, at most one of each frame type is queued at a time
+func (c *conn) queueControl(nc net.Conn, q *int32) {
+	if !atomic.CompareAndSwapInt32(q, 0, 1) {
+		// Already queued
+		return
+	}
+
+	go func() {
+		c.wmux.Lock()
+		defer c.wmux.Unlock()
+
+		if cur, err := c.netConn(); err != nil || cur != nc {
+			return
+		}
+
+		if err := c.flushControl(nc); err != nil {
+			c.setIdle(nc)
+		}
+	}()
+}
+
+// flushControl will write any queued control frames, streams call this between chunks so control frames are not held up
+// Note: This is expected to be called while the write lock is held
+func (c *conn) flushControl(nc net.Conn) (err error) {
+	if atomic.CompareAndSwapInt32(&c.pinging, 1, 0) {
+		if _, err = c.smallWrite(nc, c.newFrame(framePing), nil); err != nil {
+			return
+		}
+	}
+
+	if atomic.CompareAndSwapInt32(&c.ponging, 1, 0) {
+		_, err = c.smallWrite(nc, c.newFrame(framePong), nil)
+	}
+
+	return
+}
+
+// putClose will notify our peer that we are closing, this is best effort
+// Note: If a write is in progress, the peer will instead notice the net.Conn closing
+func (c *conn) putClose(nc net.Conn) {
+	if !c.wmux.TryLock() {
+		return
+	}
+	defer c.wmux.Unlock()
+
+	nc.SetWriteDeadline(time.Now().Add(closeTimeout))
+	c.smallWrite(nc, c.newFrame(frameClose), nil)
+}
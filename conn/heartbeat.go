@@ -0,0 +1,59 @@
+package conn
+
+import (
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// ping will answer a ping from our peer
+// Note: This is expected to be called while the read lock is held
+func (c *conn) ping(nc net.Conn) {
+	c.queueControl(nc, &c.ponging)
+}
+
+// seen will update the time we last heard from our peer
+func (c *conn) seen() {
+	atomic.StoreInt64(&c.last, time.Now().UnixNano())
+}
+
+// progress is a reader which updates our last seen time whenever bytes arrive from our peer
+// This ensures a large frame which arrives slowly is not mistaken for a dead peer
+type progress struct {
+	c *conn
+	r io.Reader
+}
+
+// Read will read from our peer, our last seen time is updated when any bytes are read
+func (p *progress) Read(b []byte) (n int, err error) {
+	if n, err = p.r.Read(b); n > 0 {
+		p.c.seen()
+	}
+
+	return
+}
+
+// heartbeat will ping our peer each interval until nc is no longer our active net.Conn
+// If we have not heard from our peer within the allowed misses, the connection is set to idle and our OnDisconnect funcs are called
+func (c *conn) heartbeat(nc net.Conn, interval time.Duration, misses int) {
+	tkr := time.NewTicker(interval)
+	defer tkr.Stop()
+
+	timeout := interval * time.Duration(misses)
+	for range tkr.C {
+		if cur, err := c.netConn(); err != nil || cur != nc {
+			return
+		}
+
+		if time.Since(time.Unix(0, atomic.LoadInt64(&c.last))) > timeout {
+			if c.setIdle(nc) && c.disconnected() {
+				c.onDisconnect()
+			}
+
+			return
+		}
+
+		c.queueControl(nc, &c.pinging)
+	}
+}
@@ -1,6 +1,11 @@
 package conn
 
-import "io"
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+)
 
 type buffer struct {
 	bs  []byte
@@ -35,3 +40,13 @@ func (b *buffer) ReadN(r io.Reader, n uint64) (err error) {
 func (b *buffer) Bytes() []byte {
 	return b.bs[:b.n]
 }
+
+// handshake will complete the TLS handshake for TLS connections, other connections are left untouched
+// Note: The deadline and cancellation of ctx are applied to the TLS handshake
+func handshake(ctx context.Context, nc net.Conn) (err error) {
+	if tc, ok := nc.(*tls.Conn); ok {
+		err = tc.HandshakeContext(ctx)
+	}
+
+	return
+}
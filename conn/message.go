@@ -0,0 +1,80 @@
+package conn
+
+import (
+	"encoding/binary"
+
+	"github.com/missionMeteora/toolkit/errors"
+)
+
+const (
+	// ErrInvalidHeaders is returned when a header block cannot be parsed
+	ErrInvalidHeaders = errors.Error("invalid message headers")
+)
+
+// Headers are message headers (e.g. content type, trace IDs or origin)
+type Headers map[string]string
+
+// Message is a message body along with it's headers
+// Note: Messages without headers are sent as regular messages
+type Message struct {
+	Headers Headers
+	Body    []byte
+}
+
+// AppendHeaders will append the encoded header block for h to buf
+// Header blocks are encoded as [uvarint count], followed by [uvarint key length][key][uvarint value length][value] for each header
+func AppendHeaders(buf []byte, h Headers) []byte {
+	buf = appendUvarint(buf, uint64(len(h)))
+	for k, v := range h {
+		buf = appendUvarint(buf, uint64(len(k)))
+		buf = append(buf, k...)
+		buf = appendUvarint(buf, uint64(len(v)))
+		buf = append(buf, v...)
+	}
+
+	return buf
+}
+
+// ReadHeaders will read a header block from the beginning of b and return the remaining bytes
+func ReadHeaders(b []byte) (h Headers, rest []byte, err error) {
+	count, n := binary.Uvarint(b)
+	// Each header is at least two bytes, this prevents a corrupt count from allocating
+	if n <= 0 || count > uint64(len(b)-n)/2 {
+		return nil, nil, ErrInvalidHeaders
+	}
+
+	b = b[n:]
+	h = make(Headers, count)
+	for i := uint64(0); i < count; i++ {
+		var k, v []byte
+		if k, b, err = readString(b); err != nil {
+			return
+		}
+
+		if v, b, err = readString(b); err != nil {
+			return
+		}
+
+		h[string(k)] = string(v)
+	}
+
+	return h, b, nil
+}
+
+// appendUvarint will append a uvarint to buf
+func appendUvarint(buf []byte, v uint64) []byte {
+	var d [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(d[:], v)
+	return append(buf, d[:n]...)
+}
+
+// readString will read a uvarint length prefixed string from the beginning of b and return the remaining bytes
+func readString(b []byte) (s, rest []byte, err error) {
+	l, n := binary.Uvarint(b)
+	if n <= 0 || uint64(len(b)-n) < l {
+		return nil, nil, ErrInvalidHeaders
+	}
+
+	b = b[n:]
+	return b[:l], b[l:], nil
+}
@@ -0,0 +1,71 @@
+package conn
+
+import "time"
+
+const (
+	// DefaultMaxFrameSize is the default maximum frame size, 64MB
+	DefaultMaxFrameSize = 1024 * 1024 * 64
+	// DefaultCompressThreshold is the default minimum message size to compress, 1KB
+	DefaultCompressThreshold = 1024
+	// DefaultFlushSize is the default number of buffered bytes which triggers a flush, 64KB
+	DefaultFlushSize = 1024 * 64
+	// DefaultReadBufferSize is the default size of the read-ahead buffer, 32KB
+	DefaultReadBufferSize = 1024 * 32
+	// DefaultHeartbeatMisses is the default number of heartbeat intervals a peer can be silent for before it is considered dead
+	DefaultHeartbeatMisses = 3
+)
+
+// Opts are connection options
+type Opts struct {
+	// Heartbeat is the interval pings are sent to the peer, heartbeats are disabled when zero
+	// Note: Peers always answer pings, only the side detecting dead peers needs heartbeats enabled
+	// Note: Pongs are received by Get, so both sides must be actively reading
+	Heartbeat time.Duration
+	// HeartbeatMisses is the number of heartbeat intervals the peer can be silent for before it is considered dead
+	// When the peer is dead, the connection is set to idle and the OnDisconnect funcs are called
+	HeartbeatMisses int
+	// MaxFrameSize is the maximum size of a frame payload in bytes, the default is DefaultMaxFrameSize
+	// Larger inbound frames are rejected before allocating and the connection is set to idle, larger puts are rejected
+	MaxFrameSize uint64
+	// Codecs are the compression codecs supported in order of preference, compression is disabled when empty
+	// The codec used is negotiated during the handshake, peers without a common codec exchange uncompressed messages
+	Codecs []Codec
+	// Checksums will append a CRC32C checksum to each frame written, corrupt frames return ErrChecksumMismatch and the connection is set to idle
+	// Note: Checksummed frames are always verified, peers do not need checksums enabled to verify ours
+	Checksums bool
+	// FlushInterval enables write buffering, small messages are buffered and written together
+	// Buffered messages are written once FlushSize bytes are buffered, FlushInterval has elapsed, or Flush is called
+	// Note: Write errors for buffered messages are not returned by Put, they set the connection to idle
+	FlushInterval time.Duration
+	// FlushSize is the number of buffered bytes which triggers a flush, the default is DefaultFlushSize
+	FlushSize int
+	// ReadBufferSize is the size of the read-ahead buffer, the default is DefaultReadBufferSize
+	// Small frames are parsed from the buffer so many frames can be read with a single read, read-ahead is disabled when negative
+	// Note: Payloads larger than the buffer are read directly into the message buffer
+	ReadBufferSize int
+	// CompressThreshold is the minimum message size in bytes to compress, the default is DefaultCompressThreshold
+	CompressThreshold int
+}
+
+// validate will fill in any missing default values
+func (o *Opts) validate() {
+	if o.HeartbeatMisses < 1 {
+		o.HeartbeatMisses = DefaultHeartbeatMisses
+	}
+
+	if o.MaxFrameSize == 0 {
+		o.MaxFrameSize = DefaultMaxFrameSize
+	}
+
+	if o.FlushSize < 1 {
+		o.FlushSize = DefaultFlushSize
+	}
+
+	if o.ReadBufferSize == 0 {
+		o.ReadBufferSize = DefaultReadBufferSize
+	}
+
+	if o.CompressThreshold < 1 {
+		o.CompressThreshold = DefaultCompressThreshold
+	}
+}
@@ -0,0 +1,34 @@
+package conn
+
+import "sync"
+
+const (
+	// maxPooledSize is the largest buffer returned to the owned pool, larger buffers are left for the garbage collector
+	maxPooledSize = 1024 * 1024
+)
+
+var ownedPool = sync.Pool{New: func() interface{} { return &Owned{} }}
+
+func newOwned() *Owned {
+	return ownedPool.Get().(*Owned)
+}
+
+// Owned is a message owned by the caller, it is valid until Release is called
+type Owned struct {
+	b []byte
+}
+
+// Bytes will return the message bytes
+func (o *Owned) Bytes() []byte {
+	return o.b
+}
+
+// Release will return the message to the pool, the message and it's bytes must not be used afterwards
+func (o *Owned) Release() {
+	if cap(o.b) > maxPooledSize {
+		o.b = nil
+	}
+
+	o.b = o.b[:0]
+	ownedPool.Put(o)
+}
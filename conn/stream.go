@@ -0,0 +1,176 @@
+package conn
+
+import (
+	"io"
+	"net"
+)
+
+const (
+	// streamChunkSize is the size of the chunks written by PutReader
+	streamChunkSize = 1024 * 32
+)
+
+// PutReader will put a message read from r, the message is streamed as chunks so it is never held in memory
+// size is the number of bytes to read from r, a size of -1 will read until r returns io.EOF
+// Note: If r ends before size bytes are read, io.ErrUnexpectedEOF is returned
+// Note: If r fails after the first chunk has been written, the connection is set to idle as the message cannot be completed
+// Note: Streamed messages require the peer to support protocol version 4, otherwise ErrUnsupportedVersion is returned
+func (c *conn) PutReader(r io.Reader, size int64) (err error) {
+	c.wmux.Lock()
+	defer c.wmux.Unlock()
+
+	var nc net.Conn
+	if nc, err = c.netConn(); err != nil {
+		return
+	}
+
+	if c.version < 4 {
+		return ErrUnsupportedVersion
+	}
+
+	if size >= 0 {
+		r = io.LimitReader(r, size)
+	}
+
+	if c.sbuf == nil {
+		c.sbuf = make([]byte, streamChunkSize)
+	}
+
+	chunk := c.sbuf
+	if uint64(len(chunk)) > c.opts.MaxFrameSize {
+		chunk = chunk[:c.opts.MaxFrameSize]
+	}
+
+	var (
+		total int64
+		sent  bool
+	)
+
+	for {
+		n, rerr := io.ReadFull(r, chunk)
+		total += int64(n)
+
+		last := rerr == io.EOF || rerr == io.ErrUnexpectedEOF || total == size
+		if rerr != nil && !last {
+			err = rerr
+			break
+		}
+
+		if last && size >= 0 && total != size {
+			err = io.ErrUnexpectedEOF
+			break
+		}
+
+		f := c.newFrame(frameData)
+		if !last {
+			f.flags |= flagMore
+		}
+
+		if _, err = c.putFrame(nc, f, chunk[:n]); err != nil {
+			c.setIdle(nc)
+			return
+		}
+
+		if last {
+			return
+		}
+
+		sent = true
+
+		// Let any queued control frames through between our chunks
+		if err = c.flushControl(nc); err != nil {
+			c.setIdle(nc)
+			return
+		}
+	}
+
+	if sent {
+		// Part of the message has been written and cannot be completed, our stream can no longer be trusted
+		c.setIdle(nc)
+	}
+
+	return
+}
+
+// GetReader will get a message and provide it to fn as a stream, chunked messages are never held in memory in full
+// Note: Please do not use the reader outside of the called function
+// Note: Any of the message left unread by fn is discarded, an error returned by fn is returned
+func (c *conn) GetReader(fn func(io.Reader) error) (err error) {
+	c.rmux.Lock()
+	defer c.rmux.Unlock()
+
+	var nc net.Conn
+	if nc, err = c.netConn(); err != nil {
+		return
+	}
+
+	var f frame
+	sr := streamReader{c: c, nc: nc}
+	if f, sr.b, _, err = c.next(nc); err != nil {
+		c.setIdle(nc)
+		return
+	}
+
+	if f.flags&flagHeaders != 0 {
+		// Headers are not part of the stream, they are only surfaced by GetMessage
+		if _, sr.b, err = ReadHeaders(sr.b); err != nil {
+			c.setIdle(nc)
+			return
+		}
+	}
+
+	sr.more = f.flags&flagMore != 0
+
+	err = fn(&sr)
+
+	// Discard the remainder of our message so the stream remains in sync
+	for sr.err == nil && sr.more {
+		sr.next()
+	}
+
+	if sr.err != nil && sr.err != io.EOF {
+		c.setIdle(nc)
+		return sr.err
+	}
+
+	return
+}
+
+// streamReader is an io.Reader over the chunks of a message
+type streamReader struct {
+	c  *conn
+	nc net.Conn
+
+	// Unread portion of the current chunk
+	b []byte
+	// Set when more chunks follow the current chunk
+	more bool
+	// Sticky read error
+	err error
+}
+
+// Read will read from the current chunk, reading the next chunk as needed
+func (s *streamReader) Read(p []byte) (n int, err error) {
+	for len(s.b) == 0 {
+		if s.err != nil {
+			return 0, s.err
+		}
+
+		if !s.more {
+			return 0, io.EOF
+		}
+
+		s.next()
+	}
+
+	n = copy(p, s.b)
+	s.b = s.b[n:]
+	return
+}
+
+// next will read the next chunk of the message
+func (s *streamReader) next() {
+	var f frame
+	f, s.b, _, s.err = s.c.next(s.nc)
+	s.more = f.flags&flagMore != 0
+}
@@ -0,0 +1,89 @@
+// Package testtls generates self-signed certificates for tests
+package testtls
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+// ClientName is the common name of generated client certificates
+const ClientName = "client"
+
+// New will return server and client configs for mutual TLS, both certificates are signed by a generated CA
+// Note: The server certificate is valid for localhost and 127.0.0.1
+func New(t testing.TB) (server, client *tls.Config) {
+	caKey, ca := newCert(t, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "ca"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil, nil)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+
+	sKey, sc := newCert(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "server"},
+		DNSNames:    []string{"localhost"},
+		IPAddresses: []net.IP{net.IPv4(127, 0, 0, 1)},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, ca, caKey)
+
+	cKey, cc := newCert(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: ClientName},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca, caKey)
+
+	server = &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{sc.Raw}, PrivateKey: sKey, Leaf: sc}},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	}
+
+	client = &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{cc.Raw}, PrivateKey: cKey, Leaf: cc}},
+		RootCAs:      pool,
+		ServerName:   "localhost",
+	}
+
+	return
+}
+
+// newCert will create a certificate from a template, signed by parent (or self-signed when parent is nil)
+func newCert(t testing.TB, tmpl, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (key *ecdsa.PrivateKey, cert *x509.Certificate) {
+	var err error
+	if key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader); err != nil {
+		t.Fatal(err)
+	}
+
+	if tmpl.SerialNumber, err = rand.Int(rand.Reader, big.NewInt(1<<62)); err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl.NotBefore = time.Now().Add(-time.Hour)
+	tmpl.NotAfter = time.Now().Add(time.Hour)
+	tmpl.KeyUsage |= x509.KeyUsageDigitalSignature
+
+	if parent == nil {
+		parent, parentKey = tmpl, key
+	}
+
+	var der []byte
+	if der, err = x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey); err != nil {
+		t.Fatal(err)
+	}
+
+	if cert, err = x509.ParseCertificate(der); err != nil {
+		t.Fatal(err)
+	}
+
+	return
+}
@@ -0,0 +1,111 @@
+package pubsub
+
+import (
+	"math/rand"
+	"time"
+)
+
+const (
+	// Reconnecting is emitted before each reconnection attempt
+	Reconnecting ReconnectState = iota
+	// Reconnected is emitted once a reconnection attempt has succeeded
+	Reconnected
+	// GaveUp is emitted when the backoff policy has ended reconnection attempts
+	GaveUp
+)
+
+// Backoff determines the delay between reconnection attempts
+type Backoff interface {
+	// Next will return the delay before the next attempt, given the number of failed attempts and
+	// the time elapsed since the connection was lost. Reconnection stops when ok is false
+	Next(attempt int, elapsed time.Duration) (delay time.Duration, ok bool)
+}
+
+// ConstantBackoff will wait a constant duration between attempts, forever
+type ConstantBackoff time.Duration
+
+// Next will return the constant delay
+func (c ConstantBackoff) Next(attempt int, elapsed time.Duration) (delay time.Duration, ok bool) {
+	return time.Duration(c), true
+}
+
+// ExponentialBackoff will grow the delay between attempts exponentially, with optional jitter and limits
+type ExponentialBackoff struct {
+	// Delay after the first failed attempt, defaults to one second
+	Initial time.Duration
+	// Maximum delay between attempts
+	Max time.Duration
+	// Factor the delay grows by after each attempt, defaults to 2
+	Multiplier float64
+	// Randomization factor (0 to 1), the delay is randomized within +/- Jitter of it's value
+	Jitter float64
+
+	// Maximum number of attempts, unlimited when zero
+	MaxAttempts int
+	// Maximum time spent reconnecting, unlimited when zero
+	MaxElapsed time.Duration
+}
+
+// Next will return the exponential delay for an attempt
+func (e *ExponentialBackoff) Next(attempt int, elapsed time.Duration) (delay time.Duration, ok bool) {
+	if e.MaxAttempts > 0 && attempt >= e.MaxAttempts {
+		return
+	}
+
+	mult := e.Multiplier
+	if mult <= 0 {
+		mult = 2
+	}
+
+	d := float64(e.Initial)
+	if d <= 0 {
+		d = float64(time.Second)
+	}
+
+	for i := 1; i < attempt && (e.Max <= 0 || d < float64(e.Max)); i++ {
+		d *= mult
+	}
+
+	if e.Max > 0 && d > float64(e.Max) {
+		d = float64(e.Max)
+	}
+
+	if e.Jitter > 0 {
+		d += d * e.Jitter * (rand.Float64()*2 - 1)
+	}
+
+	if delay = time.Duration(d); e.MaxElapsed > 0 && elapsed+delay > e.MaxElapsed {
+		return 0, false
+	}
+
+	return delay, true
+}
+
+// ReconnectState is the state of a reconnection
+type ReconnectState uint8
+
+// String will return the name of a reconnect state
+func (r ReconnectState) String() string {
+	switch r {
+	case Reconnecting:
+		return "reconnecting"
+	case Reconnected:
+		return "reconnected"
+	case GaveUp:
+		return "gave up"
+	}
+
+	return "unknown"
+}
+
+// ReconnectEvent is provided to OnReconnect funcs as a subscriber reconnects
+type ReconnectEvent struct {
+	State ReconnectState
+	// Number of the current attempt, starting at 1
+	Attempt int
+	// Error of the previous attempt, or the error which caused the disconnection
+	Err error
+}
+
+// OnReconnectFn is called on each reconnection event
+type OnReconnectFn func(ReconnectEvent)
@@ -0,0 +1,474 @@
+package pubsub
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/missionMeteora/toolkit/errors"
+)
+
+const (
+	// DefaultSegmentSize is the default maximum size of a log segment
+	DefaultSegmentSize = 1024 * 1024 * 64
+	// DefaultSyncEvery is the default interval records are synced to disk with SyncInterval
+	DefaultSyncEvery = time.Second
+
+	// segmentExt is the file extension of log segments
+	segmentExt = ".log"
+	// recordHeaderSize is the size of a record header, an 8 byte sequence followed by a 4 byte length
+	recordHeaderSize = 12
+)
+
+const (
+	// SyncNone leaves syncing records to disk to the operating system, records survive a process crash but not a power loss
+	SyncNone SyncPolicy = iota
+	// SyncAppend will sync each record to disk before it is published
+	SyncAppend
+	// SyncInterval will sync records to disk every SyncEvery, at most SyncEvery worth of records can be lost to a power loss
+	SyncInterval
+)
+
+// SyncPolicy determines when log records are synced to disk
+type SyncPolicy uint8
+
+// LogOpts are durable log options
+type LogOpts struct {
+	// SegmentSize is the maximum size of a log segment in bytes, the default is DefaultSegmentSize
+	SegmentSize int64
+	// Sync determines when records are synced to disk, the default is SyncNone
+	Sync SyncPolicy
+	// SyncEvery is the interval records are synced to disk with SyncInterval, the default is DefaultSyncEvery
+	SyncEvery time.Duration
+	// MaxSegments is the number of segments retained, the oldest segments are deleted beyond it. Unlimited when zero
+	MaxSegments int
+	// MaxBytes is the size in bytes of the segments retained, the oldest segments are deleted beyond it. Unlimited when zero
+	// Note: The active segment is always retained, so the log may exceed MaxBytes by up to SegmentSize
+	MaxBytes int64
+}
+
+// validate will fill in any missing default values
+func (o *LogOpts) validate() {
+	if o.SegmentSize <= 0 {
+		o.SegmentSize = DefaultSegmentSize
+	}
+
+	if o.SyncEvery <= 0 {
+		o.SyncEvery = DefaultSyncEvery
+	}
+}
+
+// openLog will open (or create) a segment log within dir
+// Note: A partially written record at the end of the log (e.g. from a crash) is truncated
+func openLog(dir string, opts LogOpts) (lp *plog, err error) {
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		return
+	}
+
+	opts.validate()
+
+	var l plog
+	l.dir = dir
+	l.max = opts.SegmentSize
+	l.opts = opts
+	l.done = make(chan struct{})
+
+	if l.segs, err = readSegments(dir); err != nil {
+		return
+	}
+
+	if len(l.segs) == 0 {
+		l.next = 1
+		if err = l.roll(); err != nil {
+			return
+		}
+
+		lp = l.start()
+		return
+	}
+
+	active := l.segs[len(l.segs)-1]
+	if l.next, active.size, err = scanSegment(active); err != nil {
+		return
+	}
+
+	if l.f, err = os.OpenFile(active.path, os.O_WRONLY, 0644); err != nil {
+		return
+	}
+
+	// Drop any partial record and position ourselves at the end of the segment
+	if err = l.f.Truncate(active.size); err != nil {
+		l.f.Close()
+		return
+	}
+
+	if _, err = l.f.Seek(active.size, io.SeekStart); err != nil {
+		l.f.Close()
+		return
+	}
+
+	l.trim()
+	lp = l.start()
+	return
+}
+
+// start will begin syncing the log on an interval when our sync policy requires it
+func (l *plog) start() *plog {
+	if l.opts.Sync == SyncInterval {
+		go l.syncLoop()
+	}
+
+	return l
+}
+
+// syncLoop will sync any records appended since the last sync every interval, until the log is closed
+func (l *plog) syncLoop() {
+	tkr := time.NewTicker(l.opts.SyncEvery)
+	defer tkr.Stop()
+
+	for {
+		select {
+		case <-tkr.C:
+		case <-l.done:
+			return
+		}
+
+		l.mux.Lock()
+		if !l.closed && l.dirty {
+			// A failed sync is retried on our next tick
+			l.dirty = l.f.Sync() != nil
+		}
+		l.mux.Unlock()
+	}
+}
+
+// plog is an append-only log of message frames, split into segment files
+type plog struct {
+	mux sync.RWMutex
+
+	dir  string
+	max  int64
+	opts LogOpts
+
+	// Segments, ordered by their first sequence
+	segs []*segment
+	// Active segment file
+	f *os.File
+	// Next sequence to be appended
+	next uint64
+
+	hdr [recordHeaderSize]byte
+
+	// Set when records have been appended since our last sync
+	dirty bool
+	// Closed when the log is closed, ends our sync loop
+	done chan struct{}
+
+	closed bool
+}
+
+// roll will create a new active segment starting at the next sequence
+func (l *plog) roll() (err error) {
+	if l.f != nil {
+		if l.opts.Sync != SyncNone {
+			// Our previous segment is complete, it's records are synced before it is closed
+			if err = l.f.Sync(); err != nil {
+				return
+			}
+		}
+
+		if err = l.f.Close(); err != nil {
+			return
+		}
+	}
+
+	s := segment{
+		first: l.next,
+		path:  filepath.Join(l.dir, fmt.Sprintf("%020d%s", l.next, segmentExt)),
+	}
+
+	if l.f, err = os.OpenFile(s.path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644); err != nil {
+		return
+	}
+
+	l.segs = append(l.segs, &s)
+	l.trim()
+	return
+}
+
+// trim will delete the oldest segments beyond our retention limits, the active segment is always retained
+// Note: This is expected to be called while the write lock is held
+func (l *plog) trim() {
+	var total int64
+	for _, s := range l.segs {
+		total += s.size
+	}
+
+	for len(l.segs) > 1 {
+		if (l.opts.MaxSegments <= 0 || len(l.segs) <= l.opts.MaxSegments) && (l.opts.MaxBytes <= 0 || total <= l.opts.MaxBytes) {
+			return
+		}
+
+		if err := os.Remove(l.segs[0].path); err != nil && !os.IsNotExist(err) {
+			// We will try again on our next roll
+			return
+		}
+
+		total -= l.segs[0].size
+		l.segs[0] = nil
+		l.segs = l.segs[1:]
+	}
+}
+
+// nextSeq will return the sequence which will be assigned to the next appended frame
+func (l *plog) nextSeq() uint64 {
+	l.mux.RLock()
+	defer l.mux.RUnlock()
+	return l.next
+}
+
+// append will append a frame with the next sequence
+func (l *plog) append(frame []byte) (err error) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	if l.closed {
+		return errors.ErrIsClosed
+	}
+
+	active := l.segs[len(l.segs)-1]
+	rlen := int64(recordHeaderSize + len(frame))
+	if active.size > 0 && active.size+rlen > l.max {
+		if err = l.roll(); err != nil {
+			return
+		}
+
+		active = l.segs[len(l.segs)-1]
+	}
+
+	binary.LittleEndian.PutUint64(l.hdr[:8], l.next)
+	binary.LittleEndian.PutUint32(l.hdr[8:], uint32(len(frame)))
+
+	// Note: Segment sizes only grow after a full record is written, so readers never see partial records
+	if _, err = l.f.Write(l.hdr[:]); err != nil {
+		l.rewind(active)
+		return
+	}
+
+	if _, err = l.f.Write(frame); err != nil {
+		l.rewind(active)
+		return
+	}
+
+	if l.opts.Sync == SyncAppend {
+		if err = l.f.Sync(); err != nil {
+			l.rewind(active)
+			return
+		}
+	} else {
+		l.dirty = true
+	}
+
+	active.size += rlen
+	l.next++
+	return
+}
+
+// rewind will drop a partially written record so the next append starts at the end of the active segment's complete records
+// Note: This is expected to be called while the write lock is held
+func (l *plog) rewind(active *segment) {
+	if err := l.f.Truncate(active.size); err != nil {
+		return
+	}
+
+	l.f.Seek(active.size, io.SeekStart)
+}
+
+// replay will call fn for each frame with a sequence greater than or equal to from
+// The sequence after the last replayed frame is returned, so replay can be resumed
+// Note: Only frames appended before replay was called are replayed
+func (l *plog) replay(from uint64, fn func(frame []byte) error) (next uint64, err error) {
+	l.mux.RLock()
+	if l.closed {
+		l.mux.RUnlock()
+		return from, errors.ErrIsClosed
+	}
+
+	// Take a snapshot of our segments so appends can continue while we read
+	segs := make([]segment, len(l.segs))
+	for i, s := range l.segs {
+		segs[i] = *s
+	}
+
+	if next = l.next; from > next {
+		// Nothing to replay
+		next = from
+	}
+	l.mux.RUnlock()
+
+	for i := range segs {
+		if i+1 < len(segs) && segs[i+1].first <= from {
+			// This segment ends before our starting sequence
+			continue
+		}
+
+		if err = replaySegment(&segs[i], from, fn); err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+// close will close the log
+func (l *plog) close() (err error) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	if l.closed {
+		return errors.ErrIsClosed
+	}
+
+	l.closed = true
+	close(l.done)
+	if err = l.f.Sync(); err != nil {
+		l.f.Close()
+		return
+	}
+
+	return l.f.Close()
+}
+
+// segment is a single log file
+type segment struct {
+	// First sequence within the segment
+	first uint64
+	path  string
+	// Size of all complete records
+	size int64
+}
+
+// readSegments will return the segments within a directory, ordered by their first sequence
+func readSegments(dir string) (segs []*segment, err error) {
+	var fis []os.FileInfo
+	if fis, err = ioutil.ReadDir(dir); err != nil {
+		return
+	}
+
+	for _, fi := range fis {
+		name := fi.Name()
+		if fi.IsDir() || filepath.Ext(name) != segmentExt {
+			continue
+		}
+
+		var first uint64
+		if first, err = strconv.ParseUint(strings.TrimSuffix(name, segmentExt), 10, 64); err != nil {
+			// Not one of our segments
+			err = nil
+			continue
+		}
+
+		segs = append(segs, &segment{
+			first: first,
+			path:  filepath.Join(dir, name),
+			size:  fi.Size(),
+		})
+	}
+
+	sort.Slice(segs, func(i, j int) bool {
+		return segs[i].first < segs[j].first
+	})
+
+	return
+}
+
+// scanSegment will return the sequence following the last complete record and the size of all complete records
+func scanSegment(s *segment) (next uint64, size int64, err error) {
+	next = s.first
+	err = readRecords(s.path, s.size, func(seq uint64, frame []byte) error {
+		next = seq + 1
+		size += int64(recordHeaderSize + len(frame))
+		return nil
+	})
+
+	return
+}
+
+// replaySegment will call fn for each frame within a segment with a sequence greater than or equal to from
+func replaySegment(s *segment, from uint64, fn func(frame []byte) error) (err error) {
+	if err = readRecords(s.path, s.size, func(seq uint64, frame []byte) error {
+		if seq < from {
+			return nil
+		}
+
+		return fn(frame)
+	}); os.IsNotExist(err) {
+		// Our segment was deleted by our retention limits, it's records are no longer available
+		err = nil
+	}
+
+	return
+}
+
+// readRecords will call fn for each complete record within the first size bytes of a segment file
+// Note: The frame is only valid during the call to fn
+func readRecords(path string, size int64, fn func(seq uint64, frame []byte) error) (err error) {
+	var f *os.File
+	if f, err = os.Open(path); err != nil {
+		return
+	}
+	defer f.Close()
+
+	var (
+		r     = bufio.NewReader(io.LimitReader(f, size))
+		hdr   [recordHeaderSize]byte
+		frame []byte
+		// Bytes remaining after the current record header
+		left = size
+	)
+
+	for {
+		if _, err = io.ReadFull(r, hdr[:]); err != nil {
+			break
+		}
+
+		left -= recordHeaderSize
+		seq := binary.LittleEndian.Uint64(hdr[:8])
+		flen := int(binary.LittleEndian.Uint32(hdr[8:]))
+		if int64(flen) > left {
+			// A corrupt or partially written length, this is treated as a truncated tail rather than allocated
+			err = io.ErrUnexpectedEOF
+			break
+		}
+
+		left -= int64(flen)
+		if cap(frame) < flen {
+			frame = make([]byte, flen)
+		}
+
+		frame = frame[:flen]
+		if _, err = io.ReadFull(r, frame); err != nil {
+			break
+		}
+
+		if err = fn(seq, frame); err != nil {
+			return
+		}
+	}
+
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		// We have reached the end of our complete records
+		err = nil
+	}
+
+	return
+}
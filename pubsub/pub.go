@@ -1,23 +1,31 @@
 package pubsub
 
 import (
+	"context"
+	"crypto/tls"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/missionMeteora/journaler"
 	"github.com/missionMeteora/mq.v2/conn"
+	"github.com/missionMeteora/mq.v2/transport"
 	"github.com/missionMeteora/toolkit/errors"
 )
 
-// NewPub will return a new publisher
+// NewPub will return a new publisher listening on the provided address
+// Note: Addresses may be prefixed with a transport scheme (e.g. unix:///tmp/pub.sock or inproc://events), the default is tcp
 func NewPub(addr string) (pp *Pub, err error) {
 	var p Pub
-	if p.l, err = net.Listen("tcp", addr); err != nil {
+	if p.l, err = transport.Listen(addr); err != nil {
 		return
 	}
 
-	p.sm = make(map[string]conn.Conn)
+	p.sm = make(map[string]*subscriber)
+	p.ps = make(map[string]*subscriber)
+	p.bp = sync.Pool{New: func() interface{} { return &message{} }}
+	p.mp = sync.Pool{New: func() interface{} { return make(map[*subscriber]struct{}) }}
 	p.out = journaler.New("Pub", addr)
 	p.onDC = append(p.onDC, p.remove)
 
@@ -31,9 +39,34 @@ type Pub struct {
 	out *journaler.Journaler
 
 	l net.Listener
+	// Connection options
+	opts conn.Opts
+
+	// Publishing mutex, this ensures sequences are delivered in order
+	pmux sync.Mutex
+	// Last published sequence, used when we do not have a log
+	seq uint64
+	// Durable log, nil when disabled
+	log *plog
 
 	// Subscriber map
-	sm map[string]conn.Conn
+	sm map[string]*subscriber
+	// Pending subscriber map, these subscribers buffer messages until their handshake completes
+	ps map[string]*subscriber
+
+	// Subscriber queue length, messages are written directly when zero
+	qlen int
+	// Subscriber queue overflow policy
+	policy OverflowPolicy
+	// Number of dropped messages for all subscribers
+	dropped uint64
+	// Subscription trie
+	t trie
+
+	// Message pool
+	bp sync.Pool
+	// Match set pool
+	mp sync.Pool
 
 	// On connect functions
 	onC []conn.OnConnectFn
@@ -43,22 +76,14 @@ type Pub struct {
 	closed bool
 }
 
-func (p *Pub) get(key string) (c conn.Conn, ok bool) {
+func (p *Pub) get(key string) (s *subscriber, ok bool) {
 	p.mux.RLock()
 	defer p.mux.RUnlock()
 
-	c, ok = p.sm[key]
+	s, ok = p.sm[key]
 	return
 }
 
-func (p *Pub) getConn(key string) (c conn.Conn, ok bool) {
-	p.mux.RLock()
-	c, ok = p.get(key)
-	p.mux.RUnlock()
-	return
-
-}
-
 func (p *Pub) close(wg *sync.WaitGroup) (errs *errors.ErrorList) {
 	errs = &errors.ErrorList{}
 	if p.closed {
@@ -66,14 +91,25 @@ func (p *Pub) close(wg *sync.WaitGroup) (errs *errors.ErrorList) {
 		return
 	}
 
+	p.closed = true
 	errs.Push(p.l.Close())
 
-	wg.Add(len(p.sm))
-	for _, s := range p.sm {
-		go func(c conn.Conn) {
-			errs.Push(c.Close())
-			wg.Done()
-		}(s)
+	if p.log != nil {
+		errs.Push(p.log.close())
+	}
+
+	wg.Add(len(p.sm) + len(p.ps))
+	for _, sm := range []map[string]*subscriber{p.sm, p.ps} {
+		for _, s := range sm {
+			go func(c conn.Conn) {
+				// The read loop may already be closing this connection, which is not an error for us
+				if err := c.Close(); err != errors.ErrIsClosed {
+					errs.Push(err)
+				}
+
+				wg.Done()
+			}(s.c)
+		}
 	}
 
 	return
@@ -81,28 +117,359 @@ func (p *Pub) close(wg *sync.WaitGroup) (errs *errors.ErrorList) {
 
 func (p *Pub) remove(c conn.Conn) {
 	p.mux.Lock()
+	defer p.mux.Unlock()
+
+	if s, ok := p.ps[c.Key()]; ok {
+		delete(p.ps, c.Key())
+		s.releasePending()
+		return
+	}
+
+	s, ok := p.sm[c.Key()]
+	if !ok {
+		return
+	}
+
+	for topic := range s.topics {
+		p.unsubscribe(s, topic)
+	}
+
 	delete(p.sm, c.Key())
-	p.mux.Unlock()
 }
 
-// Listen will listen for inbound subscribers
-func (p *Pub) Listen() {
+func (p *Pub) subscribe(s *subscriber, topic string) {
+	if _, ok := s.topics[topic]; ok {
+		return
+	}
+
+	p.t.insert(topic, s)
+	s.topics[topic] = struct{}{}
+}
+
+func (p *Pub) unsubscribe(s *subscriber, topic string) {
+	if _, ok := s.topics[topic]; !ok {
+		return
+	}
+
+	p.t.remove(topic, s)
+	delete(s.topics, topic)
+}
+
+// connect will connect a new net.Conn, complete the subscriber handshake and begin serving it
+func (p *Pub) connect(nc net.Conn) {
+	// The subscriber buffers messages from before OnConnect is called, so a message
+	// published as soon as a subscriber is connected will not be missed
+	s := p.pend(nc)
+
+	if err := s.c.Connect(nc); err != nil {
+		p.out.Error("", err)
+		p.remove(s.c)
+		nc.Close()
+		s.stop()
+		return
+	}
+
+	var (
+		from uint64
+		err  error
+	)
+
+	if from, err = p.handshake(s); err == nil {
+		err = p.register(s, from)
+	}
+
+	if err != nil {
+		p.out.Error("", err)
+		s.evict()
+		return
+	}
+
+	go p.serve(s)
+}
+
+// pend will create a new pending subscriber
+func (p *Pub) pend(nc net.Conn) (s *subscriber) {
+	p.pmux.Lock()
+	defer p.pmux.Unlock()
+
+	p.mux.Lock()
+	defer p.mux.Unlock()
+
+	c := conn.NewWithOpts(p.opts).OnConnect(p.onC...).OnDisconnect(p.onDC...)
+	s = newSubscriber(c, p.qlen, p.policy, &p.dropped)
+	s.start = p.nextSeq()
+	p.ps[c.Key()] = s
+	return
+}
+
+// handshake will read a subscriber's initial subscriptions until it sends it's resume operation
+func (p *Pub) handshake(s *subscriber) (from uint64, err error) {
+	var (
+		done bool
+		oerr error
+	)
+
+	fn := func(b []byte) {
+		var (
+			op  byte
+			arg []byte
+		)
+
+		if op, arg, oerr = readOp(b); oerr != nil {
+			return
+		}
+
+		switch op {
+		case opSubscribe:
+			if topic := string(arg); validPattern(topic) {
+				s.topics[topic] = struct{}{}
+			}
+
+		case opUnsubscribe:
+			delete(s.topics, string(arg))
+
+		case opResume:
+			from, oerr = readResume(arg)
+			done = true
+
+		default:
+			oerr = ErrInvalidOp
+		}
+	}
+
+	// Messages are buffered for our subscriber until it's handshake completes, so it must complete in time
+	ctx, cancel := context.WithTimeout(context.Background(), handshakeTimeout)
+	defer cancel()
+
+	for !done && oerr == nil {
+		if err = s.c.GetContext(ctx, fn); err != nil {
+			return
+		}
+	}
+
+	err = oerr
+	return
+}
+
+// register will send a pending subscriber it's backlog and promote it to a live subscriber
+// The backlog is any requested messages from our log, followed by the messages buffered while pending
+// Note: The backlog is sent through the subscriber's queue, only messages published while it was being sent are sent while holding our locks
+func (p *Pub) register(s *subscriber, from uint64) (err error) {
+	if p.log != nil && from > 0 && from < s.start {
+		// Everything before our pending subscriber started buffering is within the log
+		if _, err = p.log.replay(from, func(frame []byte) error {
+			if seq, _, _, _, _ := readMessage(frame); seq >= s.start {
+				return nil
+			}
+
+			return s.backlog(frameMessage(&p.bp, frame))
+		}); err != nil {
+			return
+		}
+	}
+
+	// Send what has been buffered so far without blocking our publishers
+	var pending []*message
+	if pending, err = p.takePending(s); err != nil {
+		return
+	}
+
+	if err = s.sendBacklog(pending); err != nil {
+		return
+	}
+
+	// Block publishers so no messages can be published between sending the remainder of our buffer and going live
+	p.pmux.Lock()
+	defer p.pmux.Unlock()
+
+	p.mux.Lock()
+	defer p.mux.Unlock()
+
+	if err = p.pending(s); err != nil {
+		return
+	}
+
+	delete(p.ps, s.c.Key())
+	pending, s.pending = s.pending, nil
+	if err = s.sendBacklog(pending); err != nil {
+		return
+	}
+
+	p.sm[s.c.Key()] = s
+	for topic := range s.topics {
+		p.t.insert(topic, s)
+	}
+
+	return
+}
+
+// takePending will take the messages buffered so far for a pending subscriber, the subscriber continues buffering
+func (p *Pub) takePending(s *subscriber) (pending []*message, err error) {
+	p.pmux.Lock()
+	defer p.pmux.Unlock()
+
+	p.mux.Lock()
+	defer p.mux.Unlock()
+
+	if err = p.pending(s); err != nil {
+		return
+	}
+
+	pending, s.pending = s.pending, nil
+	return
+}
+
+// pending will return an error if a subscriber is no longer pending
+// Note: This is expected to be called while pmux and the write lock are held
+func (p *Pub) pending(s *subscriber) (err error) {
+	if p.closed {
+		return errors.ErrIsClosed
+	}
+
+	if _, ok := p.ps[s.c.Key()]; !ok || s.overflow {
+		// Our subscriber has disconnected, or is being evicted
+		return errors.ErrIsClosed
+	}
+
+	return
+}
+
+// serve will read operations from a subscriber until the connection closes
+func (p *Pub) serve(s *subscriber) {
 	var err error
-	for {
-		var nc net.Conn
-		if nc, err = p.l.Accept(); err != nil {
+	fn := func(b []byte) {
+		var (
+			op  byte
+			arg []byte
+		)
+
+		if op, arg, err = readOp(b); err != nil {
+			return
+		}
+
+		topic := string(arg)
+		if !validPattern(topic) {
+			p.out.Error("", ErrInvalidTopic)
 			return
 		}
 
 		p.mux.Lock()
-		c := conn.New().OnConnect(p.onC...).OnDisconnect(p.onDC...)
-		if err = c.Connect(nc); err != nil {
-			p.out.Error("", err)
-		} else {
-			p.sm[c.Key()] = c
+		switch op {
+		case opSubscribe:
+			p.subscribe(s, topic)
+		case opUnsubscribe:
+			p.unsubscribe(s, topic)
+		default:
+			err = ErrInvalidOp
 		}
 		p.mux.Unlock()
 	}
+
+	for err == nil {
+		if err = s.c.Get(fn); err == ErrInvalidOp {
+			p.out.Error("", err)
+		}
+	}
+
+	// Closing will remove the subscriber from our map and call the OnDisconnect funcs
+	s.evict()
+}
+
+// deliver will send a message to a subscriber, failures are pushed to errs and failed subscribers are evicted
+// Note: errs is lazily created to avoid allocating for successful deliveries
+func (p *Pub) deliver(s *subscriber, m *message, errs *errors.ErrorList) *errors.ErrorList {
+	err := s.send(m)
+	if err == nil {
+		return errs
+	}
+
+	if errs == nil {
+		errs = &errors.ErrorList{}
+	}
+
+	errs.Push(&DeliveryError{Key: s.c.Key(), Err: err})
+	if err == ErrQueueFull && s.policy != OverflowDisconnect {
+		// The message was dropped, but the subscriber remains connected
+		return errs
+	}
+
+	// We are holding the read lock, so we evict in a separate goroutine
+	go s.evict()
+	return errs
+}
+
+// nextSeq will return the sequence of the next published message
+// Note: This is expected to be called while pmux is held
+func (p *Pub) nextSeq() uint64 {
+	if p.log == nil {
+		return p.seq + 1
+	}
+
+	return p.log.nextSeq()
+}
+
+// next will return a message with the next sequence, it is appended to our log when enabled
+// Note: This is expected to be called while pmux is held
+func (p *Pub) next(topic string, h conn.Headers, b []byte) (m *message, err error) {
+	if p.log == nil {
+		p.seq++
+		return newMessage(&p.bp, p.seq, topic, h, b), nil
+	}
+
+	m = newMessage(&p.bp, p.log.nextSeq(), topic, h, b)
+	if err = p.log.append(m.b); err != nil {
+		m.release()
+		m = nil
+	}
+
+	return
+}
+
+// buffer will append a message to the buffer of each pending subscriber
+// When a buffer is full, OverflowDropNewest and OverflowDropOldest drop messages, otherwise the subscriber is evicted
+// Note: This is expected to be called while pmux and the read lock are held
+func (p *Pub) buffer(m *message) {
+	for _, s := range p.ps {
+		if s.overflow {
+			continue
+		}
+
+		if len(s.pending) < s.maxPending() {
+			s.pending = append(s.pending, m.retain())
+			continue
+		}
+
+		switch s.policy {
+		case OverflowDropNewest:
+			s.drop(m.retain())
+
+		case OverflowDropOldest:
+			s.drop(s.pending[0])
+			copy(s.pending, s.pending[1:])
+			s.pending[len(s.pending)-1] = m.retain()
+
+		default:
+			// Blocking would stall our publishers on a subscriber which has not completed it's handshake
+			s.overflow = true
+			s.releasePending()
+			p.out.Error("", &DeliveryError{Key: s.c.Key(), Err: ErrQueueFull})
+
+			// We are holding the read lock, so we evict in a separate goroutine
+			go s.evict()
+		}
+	}
+}
+
+// Listen will listen for inbound subscribers
+func (p *Pub) Listen() {
+	for {
+		nc, err := p.l.Accept()
+		if err != nil {
+			return
+		}
+
+		go p.connect(nc)
+	}
 }
 
 // OnConnect will append an OnConnect func
@@ -119,13 +486,124 @@ func (p *Pub) OnDisconnect(fns ...conn.OnDisconnectFn) {
 	p.mux.Unlock()
 }
 
+// SetOpts will set the connection options used for new subscribers (e.g. heartbeats)
+// Note: This function is intended to be called before Listen, it is NOT thread-safe
+func (p *Pub) SetOpts(opts conn.Opts) {
+	p.opts = opts
+}
+
+// SetTLS will require subscribers to connect over TLS using the provided config
+// Note: Set cfg.ClientAuth to tls.RequireAndVerifyClientCert for mutual TLS, OnConnect funcs can then identify subscribers by their certificate
+// Note: This function is intended to be called before Listen, it is NOT thread-safe
+func (p *Pub) SetTLS(cfg *tls.Config) {
+	p.l = tls.NewListener(p.l, cfg)
+}
+
+// SetQueue will give each subscriber an outbound queue of qlen messages, drained by it's own goroutine
+// When a subscriber's queue is full, the overflow policy determines what happens to the message
+// Note: By default (qlen of 0), messages are written directly and a slow subscriber will block Put
+// Note: This function is intended to be called before Listen, it only applies to new subscribers
+func (p *Pub) SetQueue(qlen int, policy OverflowPolicy) {
+	p.mux.Lock()
+	p.qlen = qlen
+	p.policy = policy
+	p.mux.Unlock()
+}
+
+// SetLog will enable a durable log of published messages within dir, split into segments of segmentSize bytes
+// Subscribers which reconnect (or call Sub.SetOffset) will have any messages they missed replayed
+// Note: Records are not synced to disk and segments are never deleted, see SetLogWithOpts for sync policies and retention
+// Note: This function is intended to be called before Listen, it is NOT thread-safe
+func (p *Pub) SetLog(dir string, segmentSize int64) (err error) {
+	return p.SetLogWithOpts(dir, LogOpts{SegmentSize: segmentSize})
+}
+
+// SetLogWithOpts will enable a durable log of published messages within dir using the provided options
+// Note: Messages within deleted segments can no longer be replayed, subscribers resuming from them replay from the oldest retained message
+// Note: This function is intended to be called before Listen, it is NOT thread-safe
+func (p *Pub) SetLogWithOpts(dir string, opts LogOpts) (err error) {
+	var l *plog
+	if l, err = openLog(dir, opts); err != nil {
+		return
+	}
+
+	if p.log != nil {
+		p.log.close()
+	}
+
+	p.log = l
+	return
+}
+
 // Put will broadcast a message to all subscribers
-func (p *Pub) Put(b []byte) {
+// Note: Subscribers which cannot be delivered to are evicted, the returned error
+// is an errors.ErrorList of *DeliveryError naming each of them
+func (p *Pub) Put(b []byte) (err error) {
+	return p.publish(true, "", nil, b)
+}
+
+// PutTopic will send a message to all subscribers with a pattern matching the topic
+// Note: Topics are dot separated tokens (e.g. orders.eu.created), they should not contain wildcards
+// Note: Delivery failures are handled and returned the same as Put, an empty topic returns ErrEmptyTopic
+func (p *Pub) PutTopic(topic string, b []byte) (err error) {
+	if topic == "" {
+		return ErrEmptyTopic
+	}
+
+	if !validTopic(topic) {
+		return ErrInvalidTopic
+	}
+
+	return p.publish(false, topic, nil, b)
+}
+
+// PutMessage will send a message along with it's headers, an empty topic broadcasts the message the same as Put
+// Note: Other topics are validated the same as PutTopic
+// Note: Messages with headers can only be received by subscribers which support them, messages without headers are unchanged
+// Note: Delivery failures are handled and returned the same as Put
+func (p *Pub) PutMessage(topic string, m conn.Message) (err error) {
+	if topic != "" && !validTopic(topic) {
+		return ErrInvalidTopic
+	}
+
+	return p.publish(topic == "", topic, m.Headers, m.Body)
+}
+
+// publish will send a message to all subscribers when all is true, otherwise to the subscribers with a pattern matching the topic
+func (p *Pub) publish(all bool, topic string, h conn.Headers, b []byte) (err error) {
+	p.pmux.Lock()
+	defer p.pmux.Unlock()
+
+	var m *message
+	if m, err = p.next(topic, h, b); err != nil {
+		return
+	}
+
+	var errs *errors.ErrorList
+
 	p.mux.RLock()
-	for _, c := range p.sm {
-		c.Put(b)
+	if all {
+		for _, s := range p.sm {
+			errs = p.deliver(s, m.retain(), errs)
+		}
+	} else {
+		seen := p.mp.Get().(map[*subscriber]struct{})
+		p.t.match(topic, seen, func(s *subscriber) {
+			errs = p.deliver(s, m.retain(), errs)
+		})
+
+		p.mp.Put(seen)
 	}
+
+	p.buffer(m)
 	p.mux.RUnlock()
+
+	m.release()
+	if errs != nil {
+		err = errs.Err()
+	}
+
+	return
 }
 
 // Subscribers will provide a map of subscribers with their creation time as the value
@@ -134,8 +612,40 @@ func (p *Pub) Subscribers() (sm map[string]time.Time) {
 	defer p.mux.RUnlock()
 
 	sm = make(map[string]time.Time, len(p.sm))
-	for _, c := range p.sm {
-		sm[c.Key()] = c.Created()
+	for _, s := range p.sm {
+		sm[s.c.Key()] = s.c.Created()
+	}
+
+	return
+}
+
+// Dropped will return the number of messages dropped for a subscriber due to a full queue
+func (p *Pub) Dropped(key string) (n uint64) {
+	if s, ok := p.get(key); ok {
+		n = s.droppedN()
+	}
+
+	return
+}
+
+// TotalDropped will return the number of messages dropped for all subscribers, including those which have since left
+func (p *Pub) TotalDropped() uint64 {
+	return atomic.LoadUint64(&p.dropped)
+}
+
+// Topics will provide the topic patterns a subscriber is subscribed to
+func (p *Pub) Topics(key string) (topics []string) {
+	p.mux.RLock()
+	defer p.mux.RUnlock()
+
+	s, ok := p.sm[key]
+	if !ok {
+		return
+	}
+
+	topics = make([]string, 0, len(s.topics))
+	for topic := range s.topics {
+		topics = append(topics, topic)
 	}
 
 	return
@@ -143,14 +653,14 @@ func (p *Pub) Subscribers() (sm map[string]time.Time) {
 
 // Remove will remove a subscriber
 func (p *Pub) Remove(key string) (err error) {
-	c, ok := p.getConn(key)
+	s, ok := p.get(key)
 	if !ok {
 		return
 	}
 
-	if err = c.Close(); err != nil {
+	if err = s.c.Close(); err != nil {
 		// We had an error closing the connection. Let's ensure we properly remove the connection from our list
-		p.remove(c)
+		p.remove(s.c)
 	}
 
 	return
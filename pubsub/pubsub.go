@@ -0,0 +1,177 @@
+package pubsub
+
+import (
+	"encoding/binary"
+	"time"
+
+	"github.com/missionMeteora/mq.v2/conn"
+	"github.com/missionMeteora/toolkit/errors"
+)
+
+const (
+	// ErrInvalidMessage is returned when a message frame cannot be parsed
+	ErrInvalidMessage = errors.Error("invalid message")
+	// ErrInvalidOp is returned when a subscriber sends an unknown operation
+	ErrInvalidOp = errors.Error("invalid operation")
+	// ErrQueueFull is returned when a message is dropped due to a full subscriber queue
+	ErrQueueFull = errors.Error("subscriber queue is full")
+	// ErrGaveUp is returned when a subscriber's backoff policy has ended reconnection attempts
+	ErrGaveUp = errors.Error("gave up reconnecting")
+	// ErrFailback is provided to OnReconnect funcs when a secondary connection is dropped to return to the primary
+	ErrFailback = errors.Error("failing back to primary publisher")
+	// ErrInvalidTopic is returned when subscribing with an invalid topic pattern, or publishing to a topic with empty or wildcard tokens
+	ErrInvalidTopic = errors.Error("invalid topic pattern")
+	// ErrEmptyTopic is returned when publishing to an empty topic, Put is used to send to all subscribers
+	ErrEmptyTopic = errors.Error("empty topic")
+)
+
+const (
+	// DefaultPrimaryCheck is the default interval a subscriber checks it's primary address while failed over
+	DefaultPrimaryCheck = time.Second * 30
+	// DefaultPendingLen is the default number of messages buffered for a subscriber while it completes it's handshake
+	// Subscribers with a queue (see Pub.SetQueue) buffer up to their queue length instead
+	DefaultPendingLen = 1024
+
+	// dialTimeout is the timeout used when dialing publishers
+	dialTimeout = time.Second * 5
+	// handshakeTimeout is the time allowed for a subscriber to complete it's handshake
+	handshakeTimeout = time.Second * 10
+)
+
+const (
+	// opSubscribe is sent by subscribers to subscribe to a topic
+	opSubscribe byte = iota + 1
+	// opUnsubscribe is sent by subscribers to unsubscribe from a topic
+	opUnsubscribe
+	// opResume is sent by subscribers to complete the connection handshake, it contains
+	// the sequence to replay from (zero for live messages only)
+	opResume
+)
+
+// markHeaders prefixes message frames which have headers
+// Sequences start at one, so a message frame without headers never begins with a zero byte
+const markHeaders byte = 0
+
+// appendMessage will append a message frame to buf
+// Message frames are encoded as [uvarint seq][uvarint topic length][topic][body]
+// Messages with headers are encoded as [markHeaders][uvarint seq][uvarint topic length][topic][uvarint header block length][header block][body]
+// Note: Messages published without a topic have an empty topic
+func appendMessage(buf []byte, seq uint64, topic string, h conn.Headers, b []byte) []byte {
+	if len(h) > 0 {
+		buf = append(buf, markHeaders)
+	}
+
+	buf = appendUvarint(buf, seq)
+	buf = appendUvarint(buf, uint64(len(topic)))
+	buf = append(buf, topic...)
+	if len(h) > 0 {
+		buf = appendBlock(buf, h)
+	}
+
+	return append(buf, b...)
+}
+
+// appendBlock will append a length prefixed header block to buf
+func appendBlock(buf []byte, h conn.Headers) []byte {
+	start := len(buf)
+	buf = conn.AppendHeaders(buf, h)
+	blen := len(buf) - start
+
+	// Shift our header block to make room for it's length prefix
+	var d [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(d[:], uint64(blen))
+	buf = append(buf, d[:n]...)
+	copy(buf[start+n:], buf[start:start+blen])
+	copy(buf[start:], d[:n])
+	return buf
+}
+
+// readMessage will parse a message frame, hb is the encoded header block and is nil for messages without headers
+func readMessage(b []byte) (seq uint64, topic, hb, body []byte, err error) {
+	var (
+		tlen uint64
+		n    int
+	)
+
+	marked := len(b) > 0 && b[0] == markHeaders
+	if marked {
+		b = b[1:]
+	}
+
+	if seq, n = binary.Uvarint(b); n <= 0 {
+		err = ErrInvalidMessage
+		return
+	}
+
+	b = b[n:]
+	if tlen, n = binary.Uvarint(b); n <= 0 || uint64(len(b)-n) < tlen {
+		err = ErrInvalidMessage
+		return
+	}
+
+	b = b[n:]
+	topic, b = b[:tlen], b[tlen:]
+	if !marked {
+		return seq, topic, nil, b, nil
+	}
+
+	var hlen uint64
+	if hlen, n = binary.Uvarint(b); n <= 0 || uint64(len(b)-n) < hlen {
+		err = ErrInvalidMessage
+		return
+	}
+
+	b = b[n:]
+	return seq, topic, b[:hlen], b[hlen:], nil
+}
+
+// appendResume will append a resume operation frame to buf
+func appendResume(buf []byte, from uint64) []byte {
+	buf = append(buf, opResume)
+	return appendUvarint(buf, from)
+}
+
+// readOp will parse an operation frame
+func readOp(b []byte) (op byte, arg []byte, err error) {
+	if len(b) == 0 {
+		err = ErrInvalidOp
+		return
+	}
+
+	return b[0], b[1:], nil
+}
+
+// readResume will parse the argument of a resume operation
+func readResume(arg []byte) (from uint64, err error) {
+	var n int
+	if from, n = binary.Uvarint(arg); n <= 0 {
+		err = ErrInvalidOp
+	}
+
+	return
+}
+
+// appendUvarint will append a uvarint to buf
+func appendUvarint(buf []byte, v uint64) []byte {
+	var d [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(d[:], v)
+	return append(buf, d[:n]...)
+}
+
+// appendOp will append an operation frame to buf
+func appendOp(buf []byte, op byte, topic string) []byte {
+	buf = append(buf, op)
+	return append(buf, topic...)
+}
+
+// DeliveryError is returned when a message could not be delivered to a subscriber
+type DeliveryError struct {
+	// Key of the subscriber
+	Key string
+	Err error
+}
+
+// Error will return the error message along with the subscriber key
+func (e *DeliveryError) Error() string {
+	return "subscriber " + e.Key + ": " + e.Err.Error()
+}
@@ -1,12 +1,23 @@
 package pubsub
 
 import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"strings"
 	"sync"
 	"testing"
 	"time"
 
 	"github.com/missionMeteora/mq.v2/conn"
+	"github.com/missionMeteora/mq.v2/internal/testtls"
+	"github.com/missionMeteora/mq.v2/transport"
 	"github.com/missionMeteora/mq.v2/utilities"
+	"github.com/missionMeteora/toolkit/errors"
 )
 
 var testVal = []byte("hello world!")
@@ -97,3 +108,1294 @@ func TestPubSub(t *testing.T) {
 
 	wg.Wait()
 }
+
+func TestTopics(t *testing.T) {
+	var (
+		p   *Pub
+		err error
+	)
+
+	if p, err = NewPub(testTopicAddr); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	go p.Listen()
+
+	a := newTestSub(t, "a")
+	b := newTestSub(t, "b")
+	defer a.s.Close()
+	defer b.s.Close()
+
+	waitFor(t, func() bool {
+		return countTopics(p) == 2
+	})
+
+	p.PutTopic("a", []byte("a0"))
+	p.PutTopic("b", []byte("b0"))
+	p.PutTopic("c", []byte("c0"))
+
+	// An empty topic would be replayed to every subscriber, so it is rejected rather than published to no one
+	if err = p.PutTopic("", []byte("none")); err != ErrEmptyTopic {
+		t.Fatalf("invalid error, expected %v and received %v", ErrEmptyTopic, err)
+	}
+
+	p.Put([]byte("all"))
+
+	a.expect(t, "a:a0", ":all")
+	b.expect(t, "b:b0", ":all")
+
+	// Move subscriber a from topic a to topic c on the live connection
+	if err = a.s.Subscribe("c"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = a.s.Unsubscribe("a"); err != nil {
+		t.Fatal(err)
+	}
+
+	waitFor(t, func() bool {
+		for key := range p.Subscribers() {
+			if topics := p.Topics(key); len(topics) == 1 && topics[0] == "c" {
+				return true
+			}
+		}
+
+		return false
+	})
+
+	p.PutTopic("a", []byte("a1"))
+	p.PutTopic("c", []byte("c1"))
+
+	a.expect(t, "c:c1")
+}
+
+const testTopicAddr = ":16779"
+
+// testSub is a subscriber which records received messages
+type testSub struct {
+	s    *Sub
+	msgs chan string
+}
+
+func newTestSub(t *testing.T, topics ...string) *testSub {
+	ts := testSub{
+		s:    NewSub(testTopicAddr, false),
+		msgs: make(chan string, 16),
+	}
+
+	if err := ts.s.Subscribe(topics...); err != nil {
+		t.Fatal(err)
+	}
+
+	go ts.s.ListenTopic(func(topic string, b []byte) bool {
+		ts.msgs <- topic + ":" + string(b)
+		return false
+	})
+
+	return &ts
+}
+
+// expect will ensure the provided messages are the next messages received
+func (ts *testSub) expect(t *testing.T, msgs ...string) {
+	for _, expected := range msgs {
+		select {
+		case msg := <-ts.msgs:
+			if msg != expected {
+				t.Fatalf("invalid message, expected '%s' and received '%s'", expected, msg)
+			}
+
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for '%s'", expected)
+		}
+	}
+}
+
+func countTopics(p *Pub) (n int) {
+	for key := range p.Subscribers() {
+		n += len(p.Topics(key))
+	}
+
+	return
+}
+
+func waitFor(t *testing.T, fn func() bool) {
+	for i := 0; i < 100; i++ {
+		if fn() {
+			return
+		}
+
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	t.Fatal("timed out waiting for condition")
+}
+
+func TestTrie(t *testing.T) {
+	var (
+		tr   trie
+		seen = make(map[*subscriber]struct{})
+		subs = make(map[string]*subscriber)
+	)
+
+	patterns := []string{
+		"orders.*.created",
+		"orders.eu.created",
+		"orders.>",
+		"metrics.>",
+		"metrics.cpu",
+		"*",
+	}
+
+	for _, pattern := range patterns {
+		if !validPattern(pattern) {
+			t.Fatalf("expected pattern '%s' to be valid", pattern)
+		}
+
+		subs[pattern] = &subscriber{}
+		tr.insert(pattern, subs[pattern])
+	}
+
+	// Subscribe a single subscriber to overlapping patterns to ensure de-duplication
+	multi := &subscriber{}
+	tr.insert("orders.>", multi)
+	tr.insert("orders.*.created", multi)
+
+	tests := map[string][]string{
+		"orders.eu.created": {"orders.*.created", "orders.eu.created", "orders.>"},
+		"orders.us.created": {"orders.*.created", "orders.>"},
+		"orders.us":         {"orders.>"},
+		"orders":            {"*"},
+		"metrics.cpu":       {"metrics.>", "metrics.cpu"},
+		"metrics.cpu.user":  {"metrics.>"},
+		"unknown.topic":     {},
+	}
+
+	for topic, expected := range tests {
+		var (
+			matched = make(map[*subscriber]bool)
+			multiN  int
+		)
+
+		tr.match(topic, seen, func(s *subscriber) {
+			if s == multi {
+				multiN++
+				return
+			}
+
+			matched[s] = true
+		})
+
+		if len(matched) != len(expected) {
+			t.Fatalf("invalid number of matches for '%s', expected %d and received %d", topic, len(expected), len(matched))
+		}
+
+		for _, pattern := range expected {
+			if !matched[subs[pattern]] {
+				t.Fatalf("expected '%s' to match '%s'", pattern, topic)
+			}
+		}
+
+		if multiN > 1 {
+			t.Fatalf("subscriber matched %d times for '%s'", multiN, topic)
+		}
+	}
+
+	for _, pattern := range patterns {
+		tr.remove(pattern, subs[pattern])
+	}
+
+	tr.remove("orders.>", multi)
+	tr.remove("orders.*.created", multi)
+
+	if !tr.root.empty() {
+		t.Fatal("expected trie to be empty after removing all patterns")
+	}
+
+	for _, pattern := range []string{"", "orders..created", "orders.>.created", "orders.eu*", ">.a"} {
+		if validPattern(pattern) {
+			t.Fatalf("expected pattern '%s' to be invalid", pattern)
+		}
+	}
+}
+
+func TestWildcards(t *testing.T) {
+	var (
+		p   *Pub
+		err error
+	)
+
+	if p, err = NewPub(testTopicAddr); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	go p.Listen()
+
+	a := newTestSub(t, "orders.*.created", "orders.>")
+	b := newTestSub(t, "metrics.>")
+	defer a.s.Close()
+	defer b.s.Close()
+
+	if err = a.s.Subscribe("orders..created"); err != ErrInvalidTopic {
+		t.Fatalf("invalid error, expected %v and received %v", ErrInvalidTopic, err)
+	}
+
+	waitFor(t, func() bool {
+		return countTopics(p) == 3
+	})
+
+	p.PutTopic("orders.eu.created", []byte("0"))
+	p.PutTopic("metrics.cpu.user", []byte("1"))
+	p.PutTopic("orders.eu.deleted", []byte("2"))
+	p.PutTopic("metrics", []byte("3"))
+
+	// Published topics are literal, empty and wildcard tokens are rejected rather than matched by patterns
+	for _, topic := range []string{"orders..created", "orders.*.created", "orders.>", "orders.eu*.created", "orders."} {
+		if err = p.PutTopic(topic, []byte("invalid")); err != ErrInvalidTopic {
+			t.Fatalf("invalid error for %s, expected %v and received %v", topic, ErrInvalidTopic, err)
+		}
+	}
+
+	if err = p.PutMessage("orders.*", conn.Message{Body: []byte("invalid")}); err != ErrInvalidTopic {
+		t.Fatalf("invalid error, expected %v and received %v", ErrInvalidTopic, err)
+	}
+
+	p.PutTopic("orders.us.created", []byte("4"))
+
+	a.expect(t, "orders.eu.created:0", "orders.eu.deleted:2", "orders.us.created:4")
+	b.expect(t, "metrics.cpu.user:1")
+}
+
+func TestSlowSubscriber(t *testing.T) {
+	testSlowSubscriber(t, OverflowDropNewest)
+	testSlowSubscriber(t, OverflowDropOldest)
+	testSlowSubscriber(t, OverflowDisconnect)
+}
+
+func testSlowSubscriber(t *testing.T, policy OverflowPolicy) {
+	var (
+		p   *Pub
+		err error
+	)
+
+	if p, err = NewPub(testTopicAddr); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	p.SetQueue(16, policy)
+	go p.Listen()
+
+	// Our slow subscriber connects but never reads
+	var nc net.Conn
+	if nc, err = net.Dial("tcp", testTopicAddr); err != nil {
+		t.Fatal(err)
+	}
+
+	slow := conn.New()
+	defer slow.Close()
+
+	if err = slow.Connect(nc); err != nil {
+		t.Fatal(err)
+	}
+
+	// Complete our handshake without requesting a replay
+	if err = slow.Put(appendResume(nil, 0)); err != nil {
+		t.Fatal(err)
+	}
+
+	fast := newTestSub(t)
+	defer fast.s.Close()
+
+	waitFor(t, func() bool {
+		return len(p.Subscribers()) == 2
+	})
+
+	// Send enough data to fill the slow subscriber's socket buffers
+	msg := make([]byte, 1024*64)
+	n := 256
+
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < n; i++ {
+			<-fast.msgs
+		}
+
+		close(done)
+	}()
+
+	for i := 0; i < n; i++ {
+		p.Put(msg)
+		// Pace our puts so only the slow subscriber overflows
+		time.Sleep(time.Millisecond)
+	}
+
+	select {
+	case <-done:
+	case <-time.After(time.Second * 5):
+		t.Fatal("fast subscriber was blocked by the slow subscriber")
+	}
+
+	if p.TotalDropped() == 0 {
+		t.Fatal("expected messages to be dropped for the slow subscriber")
+	}
+
+	if policy == OverflowDisconnect {
+		waitFor(t, func() bool {
+			return len(p.Subscribers()) == 1
+		})
+	}
+}
+
+func TestDeliveryErrors(t *testing.T) {
+	var (
+		p   *Pub
+		err error
+	)
+
+	if p, err = NewPub(testTopicAddr); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	dc := make(chan string, 1)
+	p.OnDisconnect(func(c conn.Conn) {
+		dc <- c.Key()
+	})
+
+	// Register a subscriber whose connection is no longer usable
+	c := conn.New().OnDisconnect(p.onDC...)
+	p.mux.Lock()
+	s := newSubscriber(c, 0, OverflowBlock, &p.dropped)
+	p.sm[c.Key()] = s
+	p.subscribe(s, "a")
+	p.mux.Unlock()
+
+	if err = p.PutTopic("a", testVal); err == nil {
+		t.Fatal("expected delivery error")
+	} else if !strings.Contains(err.Error(), c.Key()) {
+		t.Fatalf("expected error to name subscriber '%s', received '%v'", c.Key(), err)
+	}
+
+	select {
+	case key := <-dc:
+		if key != c.Key() {
+			t.Fatalf("invalid key, expected '%s' and received '%s'", c.Key(), key)
+		}
+
+	case <-time.After(time.Second):
+		t.Fatal("OnDisconnect was not called for the failed subscriber")
+	}
+
+	waitFor(t, func() bool {
+		return len(p.Subscribers()) == 0
+	})
+
+	if err = p.Put(testVal); err != nil {
+		t.Fatalf("expected no error after eviction, received %v", err)
+	}
+}
+
+func TestLog(t *testing.T) {
+	var (
+		l   *plog
+		dir string
+		err error
+	)
+
+	if dir, err = ioutil.TempDir("", "mq-log"); err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Use a small segment size so our log is split across several segments
+	if l, err = openLog(dir, LogOpts{SegmentSize: 64}); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 10; i++ {
+		seq := l.nextSeq()
+		if err = l.append(appendMessage(nil, seq, "a", nil, []byte(strconv.Itoa(i)))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err = l.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(l.segs) < 2 {
+		t.Fatalf("expected multiple segments, received %d", len(l.segs))
+	}
+
+	// Simulate a crash mid-append by writing a partial record to the end of the last segment
+	// The record's length is corrupt, it claims more bytes than remain within the segment
+	var f *os.File
+	if f, err = os.OpenFile(l.segs[len(l.segs)-1].path, os.O_WRONLY|os.O_APPEND, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	f.Write([]byte{11, 0, 0, 0, 0, 0, 0, 0, 0xff, 0xff, 0xff, 0xff, 1, 2})
+	f.Close()
+
+	if l, err = openLog(dir, LogOpts{SegmentSize: 64}); err != nil {
+		t.Fatal(err)
+	}
+	defer l.close()
+
+	if seq := l.nextSeq(); seq != 11 {
+		t.Fatalf("invalid next sequence, expected %d and received %d", 11, seq)
+	}
+
+	expected := uint64(4)
+	next, err := l.replay(4, func(frame []byte) error {
+		seq, _, _, body, err := readMessage(frame)
+		if err != nil {
+			return err
+		}
+
+		if seq != expected || string(body) != strconv.Itoa(int(seq-1)) {
+			t.Fatalf("invalid message, expected sequence %d and received %d (%s)", expected, seq, body)
+		}
+
+		expected++
+		return nil
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if expected != 11 || next != 11 {
+		t.Fatalf("invalid replay, ended at %d with a next sequence of %d", expected, next)
+	}
+}
+
+func TestLogRetention(t *testing.T) {
+	var (
+		l   *plog
+		dir string
+		err error
+	)
+
+	if dir, err = ioutil.TempDir("", "mq-log"); err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if l, err = openLog(dir, LogOpts{SegmentSize: 64, Sync: SyncAppend, MaxSegments: 2}); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 10; i++ {
+		if err = l.append(appendMessage(nil, l.nextSeq(), "a", nil, []byte(strconv.Itoa(i)))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var fis []os.FileInfo
+	if fis, err = ioutil.ReadDir(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(l.segs) != 2 || len(fis) != 2 {
+		t.Fatalf("invalid segments, expected %d and received %d (%d files)", 2, len(l.segs), len(fis))
+	}
+
+	// Replaying from a deleted segment starts with the oldest retained message
+	first := l.segs[0].first
+	if _, err = l.replay(1, func(frame []byte) error {
+		seq, _, _, _, _ := readMessage(frame)
+		if seq != first {
+			t.Fatalf("invalid sequence, expected %d and received %d", first, seq)
+		}
+
+		first++
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if first != 11 {
+		t.Fatalf("invalid replay, ended at %d", first)
+	}
+
+	if err = l.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Reopening with a byte limit should trim our existing segments
+	if l, err = openLog(dir, LogOpts{SegmentSize: 64, Sync: SyncInterval, SyncEvery: time.Millisecond * 10, MaxBytes: 1}); err != nil {
+		t.Fatal(err)
+	}
+	defer l.close()
+
+	if len(l.segs) != 1 {
+		t.Fatalf("invalid segments, expected %d and received %d", 1, len(l.segs))
+	}
+
+	if err = l.append(appendMessage(nil, l.nextSeq(), "a", nil, testVal)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Our appended record should be synced by our sync loop
+	waitFor(t, func() bool {
+		l.mux.RLock()
+		defer l.mux.RUnlock()
+		return !l.dirty
+	})
+}
+
+func TestReplay(t *testing.T) {
+	var (
+		p   *Pub
+		dir string
+		err error
+	)
+
+	if dir, err = ioutil.TempDir("", "mq-log"); err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if p, err = NewPub(testTopicAddr); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	if err = p.SetLog(dir, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	go p.Listen()
+
+	a := newTestSub(t, "a")
+	waitFor(t, func() bool {
+		return len(p.Subscribers()) == 1
+	})
+
+	for i := 1; i <= 3; i++ {
+		p.PutTopic("a", []byte(strconv.Itoa(i)))
+	}
+
+	a.expect(t, "a:1", "a:2", "a:3")
+	if seq := a.s.Seq(); seq != 3 {
+		t.Fatalf("invalid sequence, expected %d and received %d", 3, seq)
+	}
+
+	a.s.Close()
+	waitFor(t, func() bool {
+		return len(p.Subscribers()) == 0
+	})
+
+	// Publish while our subscriber is away
+	p.PutTopic("a", []byte("4"))
+	p.PutTopic("b", []byte("5"))
+	p.Put([]byte("6"))
+
+	b := testSub{
+		s:    NewSub(testTopicAddr, false),
+		msgs: make(chan string, 16),
+	}
+	defer b.s.Close()
+
+	b.s.SetOffset(a.s.Seq() + 1)
+	b.s.Subscribe("a")
+	go b.s.ListenTopic(func(topic string, msg []byte) bool {
+		b.msgs <- topic + ":" + string(msg)
+		return false
+	})
+
+	waitFor(t, func() bool {
+		return len(p.Subscribers()) == 1
+	})
+
+	p.PutTopic("a", []byte("7"))
+	b.expect(t, "a:4", ":6", "a:7")
+
+	if seq := b.s.Seq(); seq != 7 {
+		t.Fatalf("invalid sequence, expected %d and received %d", 7, seq)
+	}
+}
+
+func TestExponentialBackoff(t *testing.T) {
+	b := ExponentialBackoff{
+		Initial:     time.Millisecond * 10,
+		Max:         time.Millisecond * 50,
+		MaxAttempts: 5,
+	}
+
+	expected := []time.Duration{10, 20, 40, 50}
+	for i, exp := range expected {
+		delay, ok := b.Next(i+1, 0)
+		if !ok {
+			t.Fatalf("expected attempt %d to continue", i+1)
+		}
+
+		if delay != exp*time.Millisecond {
+			t.Fatalf("invalid delay for attempt %d, expected %v and received %v", i+1, exp*time.Millisecond, delay)
+		}
+	}
+
+	if _, ok := b.Next(5, 0); ok {
+		t.Fatal("expected backoff to give up after max attempts")
+	}
+
+	b = ExponentialBackoff{
+		Initial:    time.Millisecond * 100,
+		Jitter:     0.5,
+		MaxElapsed: time.Second,
+	}
+
+	for i := 0; i < 100; i++ {
+		delay, ok := b.Next(1, 0)
+		if !ok || delay < time.Millisecond*50 || delay > time.Millisecond*150 {
+			t.Fatalf("invalid jittered delay %v", delay)
+		}
+	}
+
+	if _, ok := b.Next(1, time.Second); ok {
+		t.Fatal("expected backoff to give up after max elapsed time")
+	}
+
+	// An unset initial delay should not retry in a tight loop
+	b = ExponentialBackoff{}
+	if delay, ok := b.Next(1, 0); !ok || delay != time.Second {
+		t.Fatalf("invalid default delay, expected %v and received %v", time.Second, delay)
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	var (
+		p   *Pub
+		err error
+	)
+
+	if p, err = NewPub(testTopicAddr); err != nil {
+		t.Fatal(err)
+	}
+
+	go p.Listen()
+
+	s := NewSub(testTopicAddr, true)
+	s.SetBackoff(&ExponentialBackoff{
+		Initial:     time.Millisecond * 10,
+		MaxAttempts: 3,
+	})
+
+	evts := make(chan ReconnectEvent, 16)
+	s.OnReconnect(func(evt ReconnectEvent) {
+		evts <- evt
+	})
+
+	done := make(chan error, 1)
+	go func() {
+		done <- s.Listen(func([]byte) bool { return false })
+	}()
+
+	waitFor(t, func() bool {
+		return len(p.Subscribers()) == 1
+	})
+
+	// Our publisher goes away, our subscriber should attempt to reconnect three times before giving up
+	p.Close()
+
+	for i := 1; i <= 3; i++ {
+		if evt := <-evts; evt.State != Reconnecting || evt.Attempt != i {
+			t.Fatalf("invalid event, expected %v #%d and received %v #%d", Reconnecting, i, evt.State, evt.Attempt)
+		}
+	}
+
+	if evt := <-evts; evt.State != GaveUp || evt.Err == nil {
+		t.Fatalf("invalid event, expected %v with an error and received %v (%v)", GaveUp, evt.State, evt.Err)
+	}
+
+	if err = <-done; err != ErrGaveUp {
+		t.Fatalf("invalid error, expected %v and received %v", ErrGaveUp, err)
+	}
+
+	s.Close()
+}
+
+func TestReconnectClose(t *testing.T) {
+	var (
+		p   *Pub
+		err error
+	)
+
+	if p, err = NewPub(testTopicAddr); err != nil {
+		t.Fatal(err)
+	}
+
+	go p.Listen()
+
+	s := NewSub(testTopicAddr, true)
+	s.SetBackoff(ConstantBackoff(time.Hour))
+
+	evts := make(chan ReconnectEvent, 16)
+	s.OnReconnect(func(evt ReconnectEvent) {
+		evts <- evt
+	})
+
+	done := make(chan error, 1)
+	go func() {
+		done <- s.Listen(func([]byte) bool { return false })
+	}()
+
+	waitFor(t, func() bool {
+		return len(p.Subscribers()) == 1
+	})
+
+	p.Close()
+	<-evts
+
+	// Closing should abort our hour long backoff immediately
+	s.Close()
+
+	select {
+	case err = <-done:
+		if err != errors.ErrIsClosed {
+			t.Fatalf("invalid error, expected %v and received %v", errors.ErrIsClosed, err)
+		}
+
+	case <-time.After(time.Second):
+		t.Fatal("close did not abort reconnection")
+	}
+
+	// Reconnection should succeed once a publisher is back
+	if p, err = NewPub(testTopicAddr); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	go p.Listen()
+
+	s = NewSub(testTopicAddr, true)
+	defer s.Close()
+
+	s.SetBackoff(ConstantBackoff(time.Millisecond * 10))
+	s.OnReconnect(func(evt ReconnectEvent) {
+		evts <- evt
+	})
+
+	go s.Listen(func([]byte) bool { return false })
+	waitFor(t, func() bool {
+		return len(p.Subscribers()) == 1
+	})
+
+	// Drop the subscriber from the publisher side
+	for key := range p.Subscribers() {
+		p.Remove(key)
+	}
+
+	for evt := range evts {
+		if evt.State == Reconnected {
+			break
+		}
+	}
+
+	waitFor(t, func() bool {
+		return len(p.Subscribers()) == 1
+	})
+}
+
+func TestCloseHandshake(t *testing.T) {
+	// Our listener accepts connections, but never completes the handshake
+	l, err := transport.Listen("inproc://silent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	go func() {
+		for {
+			if _, err := l.Accept(); err != nil {
+				return
+			}
+		}
+	}()
+
+	s := NewSub("inproc://silent", true)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- s.Listen(func([]byte) bool { return false })
+	}()
+
+	time.Sleep(time.Millisecond * 20)
+
+	// Closing should abort our pending handshake immediately
+	s.Close()
+
+	select {
+	case err = <-done:
+		if err != errors.ErrIsClosed {
+			t.Fatalf("invalid error, expected %v and received %v", errors.ErrIsClosed, err)
+		}
+
+	case <-time.After(time.Second):
+		t.Fatal("close did not abort the handshake")
+	}
+}
+
+func TestFailover(t *testing.T) {
+	const (
+		primary   = ":16780"
+		secondary = ":16781"
+	)
+
+	var (
+		pp, sp *Pub
+		err    error
+	)
+
+	if sp, err = NewPub(secondary); err != nil {
+		t.Fatal(err)
+	}
+	defer sp.Close()
+
+	go sp.Listen()
+
+	s := NewFailoverSub([]string{primary, secondary}, true)
+	defer s.Close()
+
+	s.SetBackoff(ConstantBackoff(time.Millisecond * 10))
+	s.SetPrimaryCheck(time.Millisecond * 20)
+
+	evts := make(chan ReconnectEvent, 16)
+	s.OnReconnect(func(evt ReconnectEvent) {
+		evts <- evt
+	})
+
+	msgs := make(chan string, 16)
+	go s.Listen(func(b []byte) bool {
+		msgs <- string(b)
+		return false
+	})
+
+	// Our primary is down, so we should have connected to the secondary
+	waitFor(t, func() bool {
+		return len(sp.Subscribers()) == 1
+	})
+
+	if addr := s.Addr(); addr != secondary {
+		t.Fatalf("invalid address, expected %s and received %s", secondary, addr)
+	}
+
+	if err = sp.Put(testVal); err != nil {
+		t.Fatal(err)
+	}
+
+	if msg := <-msgs; msg != string(testVal) {
+		t.Fatalf("invalid message, expected %s and received %s", testVal, msg)
+	}
+
+	// Once our primary is up, we should fail back to it
+	if pp, err = NewPub(primary); err != nil {
+		t.Fatal(err)
+	}
+
+	go pp.Listen()
+
+	if evt := <-evts; evt.State != Reconnecting || evt.Err != ErrFailback {
+		t.Fatalf("invalid event, expected %v (%v) and received %v (%v)", Reconnecting, ErrFailback, evt.State, evt.Err)
+	}
+
+	waitFor(t, func() bool {
+		return len(pp.Subscribers()) == 1 && s.Addr() == primary
+	})
+
+	// Losing our primary should fail over to the secondary again
+	pp.Close()
+
+	waitFor(t, func() bool {
+		return len(sp.Subscribers()) == 1 && s.Addr() == secondary
+	})
+
+	if err = sp.Put(testVal); err != nil {
+		t.Fatal(err)
+	}
+
+	if msg := <-msgs; msg != string(testVal) {
+		t.Fatalf("invalid message, expected %s and received %s", testVal, msg)
+	}
+}
+
+func TestFailoverReplay(t *testing.T) {
+	const (
+		primary   = "inproc://primary"
+		secondary = "inproc://secondary"
+	)
+
+	var (
+		pp, sp     *Pub
+		pdir, sdir string
+		err        error
+	)
+
+	newPub := func(addr, dir string) *Pub {
+		p, err := NewPub(addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err = p.SetLog(dir, 0); err != nil {
+			t.Fatal(err)
+		}
+
+		return p
+	}
+
+	if pdir, err = ioutil.TempDir("", "mq-primary"); err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(pdir)
+
+	if sdir, err = ioutil.TempDir("", "mq-secondary"); err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(sdir)
+
+	// Our secondary's log is ahead of our primary's, it's sequences are unrelated
+	sp = newPub(secondary, sdir)
+	defer sp.Close()
+
+	for i := 0; i < 10; i++ {
+		sp.Put([]byte("secondary backlog"))
+	}
+
+	go sp.Listen()
+
+	pp = newPub(primary, pdir)
+	go pp.Listen()
+
+	s := NewFailoverSub([]string{primary, secondary}, true)
+	defer s.Close()
+
+	s.SetBackoff(ConstantBackoff(time.Millisecond * 10))
+	s.SetPrimaryCheck(time.Millisecond * 20)
+
+	msgs := make(chan string, 32)
+	go s.Listen(func(b []byte) bool {
+		msgs <- string(b)
+		return false
+	})
+
+	expect := func(exp string) {
+		select {
+		case msg := <-msgs:
+			if msg != exp {
+				t.Fatalf("invalid message, expected '%s' and received '%s'", exp, msg)
+			}
+
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for '%s'", exp)
+		}
+	}
+
+	waitFor(t, func() bool {
+		return len(pp.Subscribers()) == 1
+	})
+
+	for i := 0; i < 3; i++ {
+		pp.Put([]byte("primary"))
+		expect("primary")
+	}
+
+	// Failing over should not replay our secondary's log from our primary's sequence
+	pp.Close()
+	waitFor(t, func() bool {
+		return len(sp.Subscribers()) == 1
+	})
+
+	sp.Put([]byte("secondary"))
+	expect("secondary")
+
+	// Failing back should replay what we missed from our primary
+	pp = newPub(primary, pdir)
+	defer pp.Close()
+
+	pp.Put([]byte("missed"))
+	go pp.Listen()
+
+	expect("missed")
+}
+
+func TestTLS(t *testing.T) {
+	var (
+		p   *Pub
+		err error
+	)
+
+	sc, cc := testtls.New(t)
+
+	if p, err = NewPub(testTopicAddr); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	p.SetTLS(sc)
+	p.OnConnect(utilities.NewCertAuth(testtls.ClientName).Check)
+
+	go p.Listen()
+
+	s := NewSub(testTopicAddr, false)
+	defer s.Close()
+
+	s.SetTLS(cc)
+
+	msgs := make(chan string, 1)
+	go s.Listen(func(b []byte) bool {
+		msgs <- string(b)
+		return true
+	})
+
+	waitFor(t, func() bool {
+		return len(p.Subscribers()) == 1
+	})
+
+	if err = p.Put(testVal); err != nil {
+		t.Fatal(err)
+	}
+
+	if msg := <-msgs; msg != string(testVal) {
+		t.Fatalf("invalid message, expected %s and received %s", testVal, msg)
+	}
+
+	// Subscribers without a client certificate should be rejected
+	anon := NewSub(testTopicAddr, false)
+	defer anon.Close()
+
+	anon.SetTLS(&tls.Config{RootCAs: cc.RootCAs, ServerName: cc.ServerName})
+	if err = anon.Listen(func([]byte) bool { return true }); err == nil {
+		t.Fatal("expected subscriber without a client certificate to be rejected")
+	}
+}
+
+func TestInproc(t *testing.T) {
+	var (
+		p   *Pub
+		err error
+	)
+
+	if p, err = NewPub("inproc://pubsub"); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	go p.Listen()
+
+	s := NewSub("inproc://pubsub", false)
+	defer s.Close()
+
+	msgs := make(chan string, 1)
+	go s.Listen(func(b []byte) bool {
+		msgs <- string(b)
+		return true
+	})
+
+	waitFor(t, func() bool {
+		return len(p.Subscribers()) == 1
+	})
+
+	if err = p.Put(testVal); err != nil {
+		t.Fatal(err)
+	}
+
+	if msg := <-msgs; msg != string(testVal) {
+		t.Fatalf("invalid message, expected %s and received %s", testVal, msg)
+	}
+}
+
+func TestHeartbeat(t *testing.T) {
+	var (
+		p   *Pub
+		err error
+	)
+
+	if p, err = NewPub(testTopicAddr); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	p.SetOpts(conn.Opts{Heartbeat: time.Millisecond * 10})
+	go p.Listen()
+
+	// Our healthy subscriber answers pings while it listens
+	healthy := newTestSub(t)
+	defer healthy.s.Close()
+
+	// Our dead subscriber completes the handshake and then never reads again
+	var nc net.Conn
+	if nc, err = net.Dial("tcp", testTopicAddr); err != nil {
+		t.Fatal(err)
+	}
+
+	dead := conn.New()
+	defer dead.Close()
+
+	if err = dead.Connect(nc); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = dead.Put(appendResume(nil, 0)); err != nil {
+		t.Fatal(err)
+	}
+
+	waitFor(t, func() bool {
+		return len(p.Subscribers()) == 2
+	})
+
+	// The dead subscriber should be removed, the healthy subscriber should remain
+	waitFor(t, func() bool {
+		return len(p.Subscribers()) == 1
+	})
+
+	time.Sleep(time.Millisecond * 50)
+	if n := len(p.Subscribers()); n != 1 {
+		t.Fatalf("invalid number of subscribers, expected 1 and received %d", n)
+	}
+
+	p.Put(testVal)
+	healthy.expect(t, ":"+string(testVal))
+}
+
+func TestMessageHeaders(t *testing.T) {
+	var (
+		p   *Pub
+		err error
+	)
+
+	if p, err = NewPub("inproc://headers"); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	go p.Listen()
+
+	s := NewSub("inproc://headers", false)
+	defer s.Close()
+
+	type received struct {
+		topic string
+		m     conn.Message
+	}
+
+	msgs := make(chan received, 3)
+	go s.ListenMessage(func(topic string, m conn.Message) bool {
+		msgs <- received{topic: topic, m: conn.Message{Headers: m.Headers, Body: append([]byte(nil), m.Body...)}}
+		return false
+	})
+
+	waitFor(t, func() bool {
+		return len(p.Subscribers()) == 1
+	})
+
+	if err = s.Subscribe("orders.*"); err != nil {
+		t.Fatal(err)
+	}
+
+	waitFor(t, func() bool {
+		return countTopics(p) == 1
+	})
+
+	hdrs := conn.Headers{"origin": "test"}
+	if err = p.PutMessage("", conn.Message{Headers: hdrs, Body: testVal}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = p.PutMessage("orders.created", conn.Message{Headers: hdrs, Body: []byte("order")}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = p.Put(testVal); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, exp := range []received{
+		{m: conn.Message{Headers: hdrs, Body: testVal}},
+		{topic: "orders.created", m: conn.Message{Headers: hdrs, Body: []byte("order")}},
+		{m: conn.Message{Body: testVal}},
+	} {
+		r := <-msgs
+		if r.topic != exp.topic || r.m.Headers["origin"] != exp.m.Headers["origin"] || len(r.m.Headers) != len(exp.m.Headers) || !bytes.Equal(r.m.Body, exp.m.Body) {
+			t.Fatalf("invalid message, expected %+v and received %+v", exp, r)
+		}
+	}
+
+	// Logged frames keep their headers
+	seq, topic, hb, body, err := readMessage(appendMessage(nil, 300, "a", hdrs, testVal))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h, _, err := conn.ReadHeaders(hb)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if seq != 300 || string(topic) != "a" || h["origin"] != "test" || !bytes.Equal(body, testVal) {
+		t.Fatalf("invalid message frame, received %d, %s, %v and %s", seq, topic, h, body)
+	}
+}
+
+func TestPendingOverflow(t *testing.T) {
+	for _, policy := range []OverflowPolicy{OverflowBlock, OverflowDropNewest} {
+		p, err := NewPub("inproc://pending")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if policy != OverflowBlock {
+			p.SetQueue(4, policy)
+		}
+
+		go p.Listen()
+
+		// Our subscriber connects, but never completes it's handshake
+		var nc net.Conn
+		if nc, err = transport.Dial(context.Background(), "inproc://pending"); err != nil {
+			t.Fatal(err)
+		}
+
+		c := conn.New()
+		if err = c.Connect(nc); err != nil {
+			t.Fatal(err)
+		}
+
+		pending := func() (n int) {
+			p.pmux.Lock()
+			defer p.pmux.Unlock()
+			p.mux.RLock()
+			defer p.mux.RUnlock()
+
+			for _, s := range p.ps {
+				n += len(s.pending)
+			}
+
+			return len(p.ps) + n
+		}
+
+		waitFor(t, func() bool { return pending() == 1 })
+
+		for i := 0; i <= DefaultPendingLen; i++ {
+			if err = p.Put(testVal); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		switch policy {
+		case OverflowBlock:
+			// Our subscriber should be evicted rather than buffering without limit
+			waitFor(t, func() bool { return pending() == 0 })
+		default:
+			if n := pending(); n != 1+4 {
+				t.Fatalf("invalid pending count, expected %d and received %d", 1+4, n)
+			}
+		}
+
+		c.Close()
+		p.Close()
+	}
+}
@@ -1,21 +1,40 @@
 package pubsub
 
 import (
+	"context"
+	"crypto/tls"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"net"
 
 	"github.com/missionMeteora/journaler"
 	"github.com/missionMeteora/mq.v2/conn"
+	"github.com/missionMeteora/mq.v2/transport"
 	"github.com/missionMeteora/toolkit/errors"
 )
 
 // NewSub will accepts an address and a boolean connect on fail option and returns a new subscriber
+// Note: Addresses may be prefixed with a transport scheme (e.g. unix:///tmp/pub.sock or inproc://events), the default is tcp
 func NewSub(addr string, cof bool) *Sub {
+	return NewFailoverSub([]string{addr}, cof)
+}
+
+// NewFailoverSub will accept a list of publisher addresses and a boolean connect on fail option and returns a new subscriber
+// The first address is the primary, the remaining addresses are tried in order when the primary is unavailable.
+// While connected to a secondary address, the primary is periodically checked and failed back to once it returns
+func NewFailoverSub(addrs []string, cof bool) *Sub {
 	var s Sub
-	s.addr = addr
+	s.addrs = addrs
+	s.cur = -1
+	s.prev = -1
+	s.froms = make([]uint64, len(addrs))
 	s.cof = cof
+	s.probe = DefaultPrimaryCheck
+	s.topics = make(map[string]struct{})
+	s.backoff = ConstantBackoff(time.Second * 5)
+	s.done = make(chan struct{})
 	s.out = journaler.New("Sub")
 	return &s
 }
@@ -31,32 +50,259 @@ type Sub struct {
 	onC []conn.OnConnectFn
 	// On disconnect functions
 	onDC []conn.OnDisconnectFn
+	// On reconnect functions
+	onR []OnReconnectFn
+
+	// Reconnection backoff policy
+	backoff Backoff
+	// Closed when the subscriber is closed, this aborts reconnection
+	done chan struct{}
 
-	addr string
-	cof  bool
+	// Subscribed topics
+	topics map[string]struct{}
+	// Sequence of the last received message
+	seq uint64
+	// Sequence to replay from on our initial connection
+	from uint64
+	// Sequence to resume from for each address, sequences are only meaningful to the publisher which assigned them
+	froms []uint64
+	// Index of the address our sequence belongs to, -1 before our initial connection
+	prev int
+	// Operation buffer
+	buf []byte
+
+	// Publisher addresses, the first is our primary
+	addrs []string
+	// Index of the address we are connected to, -1 when not connected
+	cur int
+	// Current net.Conn
+	nc net.Conn
+	// Interval to check the primary address while connected to a secondary
+	probe time.Duration
+	// Set when we have dropped a secondary connection to fail back to our primary
+	failback bool
+	// TLS config, nil when connecting over plain TCP
+	tcfg *tls.Config
+	// Connection options
+	opts conn.Opts
+
+	cof bool
 
 	closed bool
 }
 
-func (s *Sub) reconnect() (err error) {
+// reconnect will attempt to reconnect until it succeeds, our backoff gives up, or we are closed
+// Note: cause is the error which caused us to lose our connection
+func (s *Sub) reconnect(cause error) (err error) {
+	s.mux.RLock()
+	backoff := s.backoff
+	s.mux.RUnlock()
+
+	var (
+		start = time.Now()
+		delay time.Duration
+		ok    bool
+	)
+
+	err = cause
+	for attempt := 1; ; attempt++ {
+		s.emit(ReconnectEvent{State: Reconnecting, Attempt: attempt, Err: err})
+
+		var (
+			nc  net.Conn
+			idx int
+		)
+
+		if nc, idx, err = s.dial(); err == nil {
+			if err = s.connect(nc, idx); err == nil {
+				s.emit(ReconnectEvent{State: Reconnected, Attempt: attempt})
+				return
+			}
+
+			s.out.Error("", err)
+		}
+
+		select {
+		case <-s.done:
+			// Our attempt was aborted by closing
+			return errors.ErrIsClosed
+		default:
+		}
+
+		if delay, ok = backoff.Next(attempt, time.Since(start)); !ok {
+			s.emit(ReconnectEvent{State: GaveUp, Attempt: attempt, Err: err})
+			return ErrGaveUp
+		}
+
+		select {
+		case <-time.After(delay):
+		case <-s.done:
+			return errors.ErrIsClosed
+		}
+	}
+}
+
+// emit will call our OnReconnect funcs with an event
+func (s *Sub) emit(evt ReconnectEvent) {
+	s.mux.RLock()
+	fns := s.onR
+	s.mux.RUnlock()
+
+	for _, fn := range fns {
+		fn(evt)
+	}
+}
+
+// dial will dial our addresses in order, returning the first successful connection and it's address index
+func (s *Sub) dial() (nc net.Conn, idx int, err error) {
+	s.mux.RLock()
+	cfg := s.tcfg
+	s.mux.RUnlock()
+
+	for idx = range s.addrs {
+		ctx, cancel := s.closing(dialTimeout)
+		if cfg != nil {
+			nc, err = transport.DialTLS(ctx, s.addrs[idx], cfg)
+		} else {
+			nc, err = transport.Dial(ctx, s.addrs[idx])
+		}
+
+		if cancel(); err == nil {
+			return
+		}
+
+		select {
+		case <-s.done:
+			return nil, idx, errors.ErrIsClosed
+		default:
+		}
+	}
+
+	return
+}
+
+// closing will return a context which ends after timeout, or once we are closed
+func (s *Sub) closing(timeout time.Duration) (ctx context.Context, cancel context.CancelFunc) {
+	ctx, cancel = context.WithTimeout(context.Background(), timeout)
+	go func() {
+		select {
+		case <-s.done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	return
+}
+
+// watchPrimary will periodically check our primary address while we are connected to a secondary address
+// Once the primary is reachable, the secondary connection is dropped so we reconnect to the primary
+func (s *Sub) watchPrimary() {
+	s.mux.RLock()
+	tkr := time.NewTicker(s.probe)
+	s.mux.RUnlock()
+	defer tkr.Stop()
+
 	for {
-		var nc net.Conn
-		if nc, err = net.Dial("tcp", s.addr); err != nil {
-			time.Sleep(time.Second * 5)
+		select {
+		case <-tkr.C:
+		case <-s.done:
+			return
+		}
+
+		s.mux.RLock()
+		secondary := s.cur > 0
+		s.mux.RUnlock()
+		if !secondary {
 			continue
 		}
 
-		if err = s.c.Connect(nc); err != nil {
-			s.out.Error("", err)
+		ctx, cancel := s.closing(dialTimeout)
+		nc, err := transport.Dial(ctx, s.addrs[0])
+		if cancel(); err != nil {
+			continue
+		}
+
+		nc.Close()
+
+		s.mux.Lock()
+		if s.cur > 0 && s.nc != nil {
+			// Closing our net.Conn will end the pending Get, and reconnect will start with the primary
+			s.failback = true
+			s.nc.Close()
+		}
+		s.mux.Unlock()
+	}
+}
+
+// connect will connect our conn to a net.Conn and declare our topics
+// Note: idx is the index of the address nc is connected to, nc is closed if we fail to connect
+func (s *Sub) connect(nc net.Conn, idx int) (err error) {
+	// Our handshake is aborted once we are closed
+	ctx, cancel := s.closing(handshakeTimeout)
+	err = s.c.ConnectContext(ctx, nc)
+	cancel()
+
+	if err != nil {
+		nc.Close()
+		select {
+		case <-s.done:
+			return errors.ErrIsClosed
+		default:
+		}
+
+		return
+	}
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	s.nc = nc
+	s.cur = idx
+
+	for topic := range s.topics {
+		if err = s.putOp(opSubscribe, topic); err != nil {
 			return
 		}
+	}
+
+	// Complete our handshake, requesting any messages we have missed from this publisher
+	from := s.resume(idx)
+
+	s.buf = appendResume(s.buf[:0], from)
+	return s.c.Put(s.buf)
+}
+
+// resume will return the sequence to replay from for the address at idx, and switch our sequence to the one for it
+// Note: Sequences of other publishers mean nothing to this publisher, so we only resume from what we last received from it
+// Note: This is expected to be called while the write lock is held
+func (s *Sub) resume(idx int) (from uint64) {
+	if s.prev == -1 {
+		// Our initial connection uses our offset
+		s.froms[idx] = s.from
+	} else if seq := atomic.LoadUint64(&s.seq); seq > 0 {
+		s.froms[s.prev] = seq + 1
+	}
+
+	s.prev = idx
 
-		break
+	// Publishers we have not received anything from start with their live messages
+	var seq uint64
+	if from = s.froms[idx]; from > 0 {
+		seq = from - 1
 	}
 
+	atomic.StoreUint64(&s.seq, seq)
 	return
 }
 
+// putOp will send an operation to the publisher
+// Note: This is expected to be called while the write lock is held
+func (s *Sub) putOp(op byte, topic string) (err error) {
+	s.buf = appendOp(s.buf[:0], op, topic)
+	return s.c.Put(s.buf)
+}
+
 // OnConnect will append an OnConnect func
 func (s *Sub) OnConnect(fns ...conn.OnConnectFn) {
 	s.mux.Lock()
@@ -71,34 +317,202 @@ func (s *Sub) OnDisconnect(fns ...conn.OnDisconnectFn) {
 	s.mux.Unlock()
 }
 
+// OnReconnect will append an OnReconnect func, these are called as the subscriber reconnects
+func (s *Sub) OnReconnect(fns ...OnReconnectFn) {
+	s.mux.Lock()
+	s.onR = append(s.onR, fns...)
+	s.mux.Unlock()
+}
+
+// SetBackoff will set the backoff policy used when reconnecting, the default is a constant five seconds
+// Note: Reconnection only occurs when the subscriber was created with connect on fail enabled
+func (s *Sub) SetBackoff(b Backoff) {
+	s.mux.Lock()
+	s.backoff = b
+	s.mux.Unlock()
+}
+
+// SetOpts will set the connection options (e.g. heartbeats)
+// Note: This function is intended to be called before Listen
+func (s *Sub) SetOpts(opts conn.Opts) {
+	s.mux.Lock()
+	s.opts = opts
+	s.mux.Unlock()
+}
+
+// SetTLS will connect to publishers over TLS using the provided config
+// Note: Provide a client certificate within cfg.Certificates for mutual TLS
+// Note: This function is intended to be called before Listen
+func (s *Sub) SetTLS(cfg *tls.Config) {
+	s.mux.Lock()
+	s.tcfg = cfg
+	s.mux.Unlock()
+}
+
+// SetPrimaryCheck will set the interval the primary address is checked while connected to a secondary address
+// Note: This function is intended to be called before Listen
+func (s *Sub) SetPrimaryCheck(interval time.Duration) {
+	s.mux.Lock()
+	s.probe = interval
+	s.mux.Unlock()
+}
+
+// Addr will return the address of the publisher we are connected to, an empty string is returned when not connected
+func (s *Sub) Addr() string {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+
+	if s.cur == -1 {
+		return ""
+	}
+
+	return s.addrs[s.cur]
+}
+
+// SetOffset will request messages to be replayed from a sequence on our initial connection
+// Note: Replays require the publisher to have a durable log, see Pub.SetLog
+// Note: This function is intended to be called before Listen
+func (s *Sub) SetOffset(from uint64) {
+	s.mux.Lock()
+	s.from = from
+	s.mux.Unlock()
+}
+
+// Seq will return the sequence of the last received message from the publisher we are connected to
+// Note: This can be persisted and provided to SetOffset (plus one) to resume a subscription with the same publisher later
+func (s *Sub) Seq() uint64 {
+	return atomic.LoadUint64(&s.seq)
+}
+
+// Subscribe will subscribe to topics, it can be called before or during Listen
+// Topics are dot separated tokens, patterns may use '*' to match a single token (e.g. orders.*.created)
+// or a trailing '>' to match one or more remaining tokens (e.g. metrics.>)
+// Note: Topics are re-declared on reconnect, so they are retained even if an error is returned
+func (s *Sub) Subscribe(topics ...string) (err error) {
+	for _, topic := range topics {
+		if !validPattern(topic) {
+			return ErrInvalidTopic
+		}
+	}
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	for _, topic := range topics {
+		if _, ok := s.topics[topic]; ok {
+			continue
+		}
+
+		s.topics[topic] = struct{}{}
+		if s.c != nil && err == nil {
+			err = s.putOp(opSubscribe, topic)
+		}
+	}
+
+	return
+}
+
+// Unsubscribe will unsubscribe from topics, it can be called before or during Listen
+func (s *Sub) Unsubscribe(topics ...string) (err error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	for _, topic := range topics {
+		if _, ok := s.topics[topic]; !ok {
+			continue
+		}
+
+		delete(s.topics, topic)
+		if s.c != nil && err == nil {
+			err = s.putOp(opUnsubscribe, topic)
+		}
+	}
+
+	return
+}
+
 // Listen will listen for new messages
+// Note: Messages published with Pub.Put are always received, topic messages are only received when subscribed
 func (s *Sub) Listen(cb func([]byte) (end bool)) (err error) {
-	var ended bool
+	return s.ListenTopic(func(_ string, b []byte) bool {
+		return cb(b)
+	})
+}
+
+// ListenTopic will listen for new messages along with the topic they were published to
+// Note: Messages published with Pub.Put have an empty topic
+func (s *Sub) ListenTopic(cb func(topic string, b []byte) (end bool)) (err error) {
+	return s.ListenMessage(func(topic string, m conn.Message) bool {
+		return cb(topic, m.Body)
+	})
+}
+
+// ListenMessage will listen for new messages along with the topic they were published to and their headers
+// Note: Messages published without headers have nil Headers, the headers may be retained
+func (s *Sub) ListenMessage(cb func(topic string, m conn.Message) (end bool)) (err error) {
+	var (
+		ended bool
+		topic string
+	)
+
 	fn := func(b []byte) {
-		if cb(b) {
+		seq, t, hb, body, merr := readMessage(b)
+		if merr != nil {
+			s.out.Error("", merr)
+			return
+		}
+
+		var h conn.Headers
+		if hb != nil {
+			if h, _, merr = conn.ReadHeaders(hb); merr != nil {
+				s.out.Error("", merr)
+				return
+			}
+		}
+
+		atomic.StoreUint64(&s.seq, seq)
+
+		if string(t) != topic {
+			// Only allocate a new topic string when the topic changes
+			topic = string(t)
+		}
+
+		if cb(topic, conn.Message{Headers: h, Body: body}) {
 			ended = true
 		}
 	}
 
-	var nc net.Conn
-	if nc, err = net.Dial("tcp", s.addr); err != nil {
+	var (
+		nc  net.Conn
+		idx int
+	)
+
+	if nc, idx, err = s.dial(); err != nil {
 		return
 	}
 
-	s.c = conn.New().OnConnect(s.onC...).OnDisconnect(s.onDC...)
+	s.mux.Lock()
+	s.c = conn.NewWithOpts(s.opts).OnConnect(s.onC...).OnDisconnect(s.onDC...)
+	s.mux.Unlock()
 
-	if err = s.c.Connect(nc); err != nil {
+	if err = s.connect(nc, idx); err != nil {
 		return
 	}
 
+	if len(s.addrs) > 1 && s.cof {
+		go s.watchPrimary()
+	}
+
 	for !ended {
 		s.mux.RLock()
-		if s.closed {
+		closed := s.closed
+		s.mux.RUnlock()
+
+		if closed {
 			err = errors.ErrIsClosed
 		} else {
 			err = s.c.Get(fn)
 		}
-		s.mux.RUnlock()
 
 		switch err {
 		case nil:
@@ -106,14 +520,23 @@ func (s *Sub) Listen(cb func([]byte) (end bool)) (err error) {
 			return
 
 		default:
-			s.mux.RLock()
+			s.mux.Lock()
 			reconnect := !s.closed && s.cof
-			s.mux.RUnlock()
+			if s.failback {
+				// We dropped our secondary connection, reconnect will prefer the primary
+				err = ErrFailback
+				s.failback = false
+			}
+
+			s.nc = nil
+			s.cur = -1
+			s.mux.Unlock()
+
 			if !reconnect {
 				return
 			}
 
-			if err = s.reconnect(); err != nil {
+			if err = s.reconnect(err); err != nil {
 				return
 			}
 		}
@@ -131,6 +554,8 @@ func (s *Sub) Close() (err error) {
 		return errors.ErrIsClosed
 	}
 
+	s.closed = true
+	close(s.done)
 	if s.c == nil {
 		return
 	}
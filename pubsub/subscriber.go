@@ -0,0 +1,272 @@
+package pubsub
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/missionMeteora/mq.v2/conn"
+	"github.com/missionMeteora/toolkit/errors"
+)
+
+const (
+	// OverflowBlock will block the publisher until the subscriber's queue has room
+	OverflowBlock OverflowPolicy = iota
+	// OverflowDropNewest will drop the message being published when the subscriber's queue is full
+	OverflowDropNewest
+	// OverflowDropOldest will drop the oldest queued message when the subscriber's queue is full
+	OverflowDropOldest
+	// OverflowDisconnect will disconnect the subscriber when it's queue is full
+	OverflowDisconnect
+)
+
+// OverflowPolicy determines how a full subscriber queue is handled
+type OverflowPolicy uint8
+
+func newSubscriber(c conn.Conn, qlen int, policy OverflowPolicy, total *uint64) *subscriber {
+	s := subscriber{
+		c:      c,
+		topics: make(map[string]struct{}),
+		policy: policy,
+		total:  total,
+		done:   make(chan struct{}),
+	}
+
+	if qlen > 0 {
+		s.q = make(chan *message, qlen)
+		go s.drain()
+	}
+
+	return &s
+}
+
+// subscriber is a connected subscriber
+type subscriber struct {
+	c conn.Conn
+	// Topics the subscriber is subscribed to
+	topics map[string]struct{}
+
+	// Outbound queue, nil when messages are written directly
+	q      chan *message
+	policy OverflowPolicy
+	// Number of dropped messages
+	dropped uint64
+	// Number of dropped messages for all subscribers of the publisher
+	total *uint64
+
+	// Sequence from which messages were buffered while pending
+	start uint64
+	// Messages published while pending
+	pending []*message
+	// Set when the pending buffer has overflowed and the subscriber is being evicted
+	overflow bool
+
+	once sync.Once
+	done chan struct{}
+}
+
+// send will write or enqueue a message, the message is released once it has been handled
+// Note: An error is returned if the message could not be written or enqueued
+func (s *subscriber) send(m *message) (err error) {
+	if s.q == nil {
+		err = s.c.Put(m.b)
+		m.release()
+		return
+	}
+
+	switch s.policy {
+	case OverflowBlock:
+		select {
+		case s.q <- m:
+		case <-s.done:
+			m.release()
+			err = errors.ErrIsClosed
+		}
+
+	case OverflowDropNewest:
+		select {
+		case s.q <- m:
+		default:
+			s.drop(m)
+			err = ErrQueueFull
+		}
+
+	case OverflowDropOldest:
+		for {
+			select {
+			case s.q <- m:
+				return
+			default:
+			}
+
+			select {
+			case old := <-s.q:
+				s.drop(old)
+			default:
+				// Our drain loop emptied a slot in the meantime
+			}
+		}
+
+	case OverflowDisconnect:
+		select {
+		case s.q <- m:
+		default:
+			s.drop(m)
+			err = ErrQueueFull
+		}
+	}
+
+	return
+}
+
+func (s *subscriber) drop(m *message) {
+	atomic.AddUint64(&s.dropped, 1)
+	atomic.AddUint64(s.total, 1)
+	m.release()
+}
+
+// drain will write queued messages until the subscriber is stopped
+func (s *subscriber) drain() {
+	for {
+		select {
+		case m := <-s.q:
+			if err := s.c.Put(m.b); err != nil {
+				s.evict()
+			}
+
+			m.release()
+
+		case <-s.done:
+			for {
+				select {
+				case m := <-s.q:
+					m.release()
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// matches will return whether or not a message topic should be sent to the subscriber
+// Note: This is used for replays, live messages are matched using the publisher's trie
+func (s *subscriber) matches(topic []byte) bool {
+	if len(topic) == 0 {
+		// Messages without a topic are sent to all subscribers
+		return true
+	}
+
+	t := string(topic)
+	for pattern := range s.topics {
+		if matchPattern(pattern, t) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// backlog will send a backlog message if it matches the subscriber's topics, the message is released once it has been handled
+// Note: Messages dropped by the overflow policy are not an error, unless the policy is OverflowDisconnect
+func (s *subscriber) backlog(m *message) (err error) {
+	var topic []byte
+	if _, topic, _, _, err = readMessage(m.b); err != nil || !s.matches(topic) {
+		m.release()
+		return
+	}
+
+	if err = s.send(m); err == ErrQueueFull && s.policy != OverflowDisconnect {
+		err = nil
+	}
+
+	return
+}
+
+// sendBacklog will send backlog messages in order until one fails, all of the messages are released
+func (s *subscriber) sendBacklog(ms []*message) (err error) {
+	for _, m := range ms {
+		if err != nil {
+			m.release()
+			continue
+		}
+
+		err = s.backlog(m)
+	}
+
+	return
+}
+
+// maxPending will return the maximum number of messages buffered while the subscriber is pending
+func (s *subscriber) maxPending() int {
+	if s.q != nil {
+		return cap(s.q)
+	}
+
+	return DefaultPendingLen
+}
+
+// releasePending will release the messages buffered while the subscriber was pending
+func (s *subscriber) releasePending() {
+	for _, m := range s.pending {
+		m.release()
+	}
+
+	s.pending = nil
+}
+
+// evict will stop the subscriber and close it's connection, which calls the OnDisconnect funcs
+// Note: The OnDisconnect funcs require the publisher lock, so this should be called in a separate goroutine when it is held
+func (s *subscriber) evict() {
+	s.stop()
+	s.c.Close()
+}
+
+// stop will stop the drain loop and unblock any pending sends
+func (s *subscriber) stop() {
+	s.once.Do(func() {
+		close(s.done)
+	})
+}
+
+// droppedN will return the number of messages dropped for this subscriber
+func (s *subscriber) droppedN() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
+
+// newMessage will return a message frame from the pool with a single reference
+func newMessage(mp *sync.Pool, seq uint64, topic string, h conn.Headers, b []byte) (m *message) {
+	m = mp.Get().(*message)
+	m.b = appendMessage(m.b[:0], seq, topic, h, b)
+	m.refs = 1
+	m.pool = mp
+	return
+}
+
+// frameMessage will return a message from the pool for an encoded message frame with a single reference
+func frameMessage(mp *sync.Pool, frame []byte) (m *message) {
+	m = mp.Get().(*message)
+	m.b = append(m.b[:0], frame...)
+	m.refs = 1
+	m.pool = mp
+	return
+}
+
+// message is a reference counted message frame, shared between subscriber queues
+type message struct {
+	b    []byte
+	refs int32
+	pool *sync.Pool
+}
+
+// retain will add a reference to the message
+func (m *message) retain() *message {
+	atomic.AddInt32(&m.refs, 1)
+	return m
+}
+
+// release will remove a reference, the message is returned to the pool when no references remain
+func (m *message) release() {
+	if atomic.AddInt32(&m.refs, -1) == 0 {
+		m.pool.Put(m)
+	}
+}
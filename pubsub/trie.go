@@ -0,0 +1,195 @@
+package pubsub
+
+import "strings"
+
+const (
+	// topicSep separates the tokens of a hierarchical topic
+	topicSep = '.'
+	// wildcardOne matches exactly one token
+	wildcardOne = "*"
+	// wildcardRest matches one or more trailing tokens, it must be the final token of a pattern
+	wildcardRest = ">"
+)
+
+// validPattern will return whether or not a subscription pattern is valid
+func validPattern(pattern string) bool {
+	if pattern == "" {
+		return false
+	}
+
+	for rest := pattern; ; {
+		token, next, last := nextToken(rest)
+		switch {
+		case token == "":
+			return false
+		case token == wildcardRest && !last:
+			return false
+		case token != wildcardOne && token != wildcardRest && strings.ContainsAny(token, "*>"):
+			return false
+		}
+
+		if last {
+			return true
+		}
+
+		rest = next
+	}
+}
+
+// validTopic will return whether or not a published topic is valid, topics are patterns without wildcards
+func validTopic(topic string) bool {
+	return !strings.ContainsAny(topic, "*>") && validPattern(topic)
+}
+
+// matchPattern will return whether or not a topic matches a subscription pattern
+func matchPattern(pattern, topic string) bool {
+	for {
+		ptoken, prest, plast := nextToken(pattern)
+		token, rest, last := nextToken(topic)
+
+		switch {
+		case ptoken == wildcardRest:
+			return true
+		case ptoken != wildcardOne && ptoken != token:
+			return false
+		case plast || last:
+			return plast && last
+		}
+
+		pattern, topic = prest, rest
+	}
+}
+
+// nextToken will return the first token of a topic, the remaining topic, and whether or not it was the last token
+func nextToken(topic string) (token, rest string, last bool) {
+	i := strings.IndexByte(topic, topicSep)
+	if i == -1 {
+		return topic, "", true
+	}
+
+	return topic[:i], topic[i+1:], false
+}
+
+// trie is a subject trie used to match published topics to subscription patterns
+type trie struct {
+	root node
+}
+
+// insert will add a subscriber for a pattern
+func (t *trie) insert(pattern string, s *subscriber) {
+	n := &t.root
+	for rest := pattern; ; {
+		token, next, last := nextToken(rest)
+		n = n.child(token)
+		if last {
+			break
+		}
+
+		rest = next
+	}
+
+	if n.subs == nil {
+		n.subs = make(map[*subscriber]struct{})
+	}
+
+	n.subs[s] = struct{}{}
+}
+
+// remove will remove a subscriber for a pattern, empty nodes are pruned
+func (t *trie) remove(pattern string, s *subscriber) {
+	t.root.remove(pattern, s)
+}
+
+// match will call fn once for each subscriber with a pattern matching topic
+// Note: seen is used to de-duplicate subscribers with multiple matching patterns, it is cleared before returning
+func (t *trie) match(topic string, seen map[*subscriber]struct{}, fn func(*subscriber)) {
+	t.root.match(topic, func(s *subscriber) {
+		if _, ok := seen[s]; ok {
+			return
+		}
+
+		seen[s] = struct{}{}
+		fn(s)
+	})
+
+	for s := range seen {
+		delete(seen, s)
+	}
+}
+
+// node is a single token within a trie
+type node struct {
+	children map[string]*node
+	// Subscribers whose pattern ends at this node
+	subs map[*subscriber]struct{}
+}
+
+// child will return the child node for a token, creating it if it does not exist
+func (n *node) child(token string) (c *node) {
+	if n.children == nil {
+		n.children = make(map[string]*node)
+	}
+
+	if c = n.children[token]; c == nil {
+		c = &node{}
+		n.children[token] = c
+	}
+
+	return
+}
+
+// remove will remove a subscriber for a pattern and return whether or not this node is now empty
+func (n *node) remove(pattern string, s *subscriber) (empty bool) {
+	token, rest, last := nextToken(pattern)
+	c, ok := n.children[token]
+	if !ok {
+		return n.empty()
+	}
+
+	if last {
+		delete(c.subs, s)
+	}
+
+	if (last && c.empty()) || (!last && c.remove(rest, s)) {
+		delete(n.children, token)
+	}
+
+	return n.empty()
+}
+
+func (n *node) empty() bool {
+	return len(n.children) == 0 && len(n.subs) == 0
+}
+
+func (n *node) match(topic string, fn func(*subscriber)) {
+	token, rest, last := nextToken(topic)
+
+	if c := n.children[wildcardRest]; c != nil {
+		// The remainder of the topic is matched by this node
+		c.each(fn)
+	}
+
+	if c := n.children[wildcardOne]; c != nil {
+		c.matchNext(rest, last, fn)
+	}
+
+	if c := n.children[token]; c != nil {
+		c.matchNext(rest, last, fn)
+	}
+}
+
+// matchNext will match the remaining topic against a node which has matched the current token
+func (n *node) matchNext(rest string, last bool, fn func(*subscriber)) {
+	if last {
+		n.each(fn)
+		return
+	}
+
+	n.match(rest, fn)
+}
+
+func (n *node) each(fn func(*subscriber)) {
+	for s := range n.subs {
+		fn(s)
+	}
+}
@@ -1,19 +1,342 @@
 package reqresp
 
 import (
+	"context"
+	"crypto/tls"
+	"net"
+	"sync"
+
 	"github.com/missionMeteora/mq.v2/conn"
+	"github.com/missionMeteora/mq.v2/transport"
+	"github.com/missionMeteora/toolkit/errors"
 )
 
-// Request is the request type
-type Request struct {
+// NewRequester will return a new requester for the provided address
+// Note: Addresses may be prefixed with a transport scheme (e.g. unix:///tmp/resp.sock or inproc://users), the default is tcp
+// Note: The connection is established on the first request
+func NewRequester(addr string) *Requester {
+	var r Requester
+	r.addr = addr
+	r.pm = make(map[uint64]*pending)
+	r.bp = sync.Pool{New: func() interface{} { return new([]byte) }}
+	return &r
+}
+
+// Requester is the requesting side of a request/response pair
+// Note: Requests are pipelined over a single connection, Request is safe to call concurrently
+type Requester struct {
+	mux sync.Mutex
+
+	// Current connection, nil when we are not connected
 	c conn.Conn
+	// Closed once the in-flight dial completes, nil when we are not dialing
+	dialing chan struct{}
+
+	// Pending request map
+	pm map[uint64]*pending
+	// Request id counter
+	id uint64
+	// Request buffer pool
+	bp sync.Pool
+
+	// On connect functions
+	onC []conn.OnConnectFn
+	// On disconnect functions
+	onDC []conn.OnDisconnectFn
+
+	addr string
+	// TLS config, nil when connecting over plain TCP
+	tcfg *tls.Config
+	// Connection options
+	opts conn.Opts
+
+	closed bool
+}
+
+// connect will dial the responder if we are not currently connected, ctx is applied to the dial and the handshake
+// Note: Only one dial is in-flight at a time, other callers wait for it to complete or for their ctx to end
+// Note: This is expected to be called while the lock is held, the lock is released while dialing
+func (r *Requester) connect(ctx context.Context) (err error) {
+	for r.c == nil {
+		if r.closed {
+			return errors.ErrIsClosed
+		}
+
+		if wait := r.dialing; wait != nil {
+			r.mux.Unlock()
+			select {
+			case <-wait:
+			case <-ctx.Done():
+				err = ctx.Err()
+			}
+
+			r.mux.Lock()
+			if err != nil {
+				return
+			}
+
+			// The dial has completed, check it's result
+			continue
+		}
+
+		r.dialing = make(chan struct{})
+		c := conn.NewWithOpts(r.opts).OnConnect(r.onC...).OnDisconnect(r.onDC...)
+		cfg := r.tcfg
+
+		r.mux.Unlock()
+		err = r.dial(ctx, c, cfg)
+		r.mux.Lock()
+
+		close(r.dialing)
+		r.dialing = nil
+		if err != nil {
+			return
+		}
+
+		if r.closed {
+			// We were closed while dialing
+			c.Close()
+			return errors.ErrIsClosed
+		}
+
+		r.c = c
+		go r.listen(c)
+	}
+
+	return
+}
+
+// dial will dial the responder and connect c, the dial and handshake are aborted if ctx ends
+func (r *Requester) dial(ctx context.Context, c conn.Conn, cfg *tls.Config) (err error) {
+	var nc net.Conn
+	if cfg != nil {
+		nc, err = transport.DialTLS(ctx, r.addr, cfg)
+	} else {
+		nc, err = transport.Dial(ctx, r.addr)
+	}
+
+	if err != nil {
+		return
+	}
+
+	if err = c.ConnectContext(ctx, nc); err != nil {
+		nc.Close()
+	}
+
+	return
+}
+
+// listen will read responses for a connection until it errors
+func (r *Requester) listen(c conn.Conn) {
+	var err error
+	fn := func(m conn.Message) {
+		id, b, ok := readID(m.Body)
+		if !ok {
+			return
+		}
+
+		if p := r.pop(id); p != nil {
+			m.Body = b
+			p.done <- parseResponse(m, p.fn)
+		}
+	}
+
+	for err == nil {
+		err = c.GetMessage(fn)
+	}
+
+	r.mux.Lock()
+	if r.closed {
+		err = errors.ErrIsClosed
+	}
+
+	if r.c == c {
+		// Our connection is now idle, we will re-dial on the next request
+		r.c = nil
+	}
+
+	// Fail all requests which were sent over this connection
+	for id, p := range r.pm {
+		if p.c != c {
+			continue
+		}
+
+		delete(r.pm, id)
+		p.done <- err
+	}
+	r.mux.Unlock()
+
+	c.Close()
+}
+
+// push will register a new pending request and return it's id, ctx is applied to connecting if we are not connected
+func (r *Requester) push(ctx context.Context, fn func(conn.Message)) (id uint64, p *pending, err error) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	if err = r.connect(ctx); err != nil {
+		return
+	}
+
+	r.id++
+	id = r.id
+	p = &pending{
+		c:    r.c,
+		fn:   fn,
+		done: make(chan error, 1),
+	}
+
+	r.pm[id] = p
+	return
+}
+
+// pop will remove and return a pending request, nil is returned if the request does not exist
+func (r *Requester) pop(id uint64) (p *pending) {
+	r.mux.Lock()
+	if p = r.pm[id]; p != nil {
+		delete(r.pm, id)
+	}
+	r.mux.Unlock()
+	return
+}
+
+// SetOpts will set the connection options (e.g. heartbeats)
+// Note: This function is intended to be called before the first request, it only applies to new connections
+func (r *Requester) SetOpts(opts conn.Opts) {
+	r.mux.Lock()
+	r.opts = opts
+	r.mux.Unlock()
+}
+
+// SetTLS will connect to the responder over TLS using the provided config
+// Note: Provide a client certificate within cfg.Certificates for mutual TLS
+// Note: This function is intended to be called before the first request, it only applies to new connections
+func (r *Requester) SetTLS(cfg *tls.Config) {
+	r.mux.Lock()
+	r.tcfg = cfg
+	r.mux.Unlock()
+}
+
+// OnConnect will append an OnConnect func
+func (r *Requester) OnConnect(fns ...conn.OnConnectFn) {
+	r.mux.Lock()
+	r.onC = append(r.onC, fns...)
+	r.mux.Unlock()
+}
+
+// OnDisconnect will append an onDisconnect func
+func (r *Requester) OnDisconnect(fns ...conn.OnDisconnectFn) {
+	r.mux.Lock()
+	r.onDC = append(r.onDC, fns...)
+	r.mux.Unlock()
 }
 
-// Request is the request type
-func (r *Request) Request(b []byte, fn func([]byte)) (err error) {
-	if err = r.c.Put(b); err != nil {
+// Request will send a request and call fn with the response
+// Note: If the responder's handler errors, a RemoteError is returned and fn is not called
+// Note: fn is called from the requester's read loop, please do not block within it
+// Note: Please do not use the bytes outside of the called function
+func (r *Requester) Request(b []byte, fn func([]byte)) (err error) {
+	return r.RequestContext(context.Background(), b, fn)
+}
+
+// RequestContext will send a request and call fn with the response
+// Note: If ctx ends before the response arrives, ctx.Err() is returned and the response will be discarded
+func (r *Requester) RequestContext(ctx context.Context, b []byte, fn func([]byte)) (err error) {
+	var mfn func(conn.Message)
+	if fn != nil {
+		mfn = func(m conn.Message) { fn(m.Body) }
+	}
+
+	return r.RequestMessage(ctx, conn.Message{Body: b}, mfn)
+}
+
+// RequestMessage will send a request along with it's headers and call fn with the response and it's headers
+// Note: Headers require a responder which supports them, otherwise conn.ErrUnsupportedVersion is returned
+// Note: Errors and ctx are handled the same as RequestContext, the response headers may be retained
+func (r *Requester) RequestMessage(ctx context.Context, m conn.Message, fn func(conn.Message)) (err error) {
+	var (
+		id uint64
+		p  *pending
+	)
+
+	if err = ctx.Err(); err != nil {
+		return
+	}
+
+	if id, p, err = r.push(ctx, fn); err != nil {
 		return
 	}
 
-	return r.c.Get(fn)
+	buf := r.bp.Get().(*[]byte)
+	*buf = append(appendID((*buf)[:0], id), m.Body...)
+	err = p.c.PutMessageContext(ctx, conn.Message{Headers: m.Headers, Body: *buf})
+	r.bp.Put(buf)
+
+	if err != nil && r.pop(id) != nil {
+		// Our request was never sent, the read loop will not be failing it
+		return
+	}
+
+	select {
+	case err = <-p.done:
+	case <-ctx.Done():
+		if r.pop(id) != nil {
+			return ctx.Err()
+		}
+
+		// Our response is being handled by the read loop, wait for it to complete
+		err = <-p.done
+	}
+
+	return
+}
+
+// Close will close the requester
+func (r *Requester) Close() (err error) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	if r.closed {
+		return errors.ErrIsClosed
+	}
+
+	r.closed = true
+	if r.c == nil {
+		return
+	}
+
+	// Closing the connection will end the read loop, which fails any pending requests
+	return r.c.Close()
+}
+
+// parseResponse will parse a response frame, fn is called with the payload and headers of successful responses
+func parseResponse(m conn.Message, fn func(conn.Message)) (err error) {
+	if len(m.Body) == 0 {
+		return ErrInvalidResponse
+	}
+
+	switch m.Body[0] {
+	case statusOK:
+		if fn != nil {
+			m.Body = m.Body[1:]
+			fn(m)
+		}
+
+	case statusError:
+		err = RemoteError(m.Body[1:])
+
+	default:
+		err = ErrInvalidResponse
+	}
+
+	return
+}
+
+// pending is an in-flight request
+type pending struct {
+	// Connection the request was sent over
+	c  conn.Conn
+	fn func(conn.Message)
+
+	done chan error
 }
@@ -0,0 +1,53 @@
+package reqresp
+
+import (
+	"encoding/binary"
+	"time"
+
+	"github.com/missionMeteora/toolkit/errors"
+)
+
+const (
+	// ErrInvalidResponse is returned when a response frame cannot be parsed
+	ErrInvalidResponse = errors.Error("invalid response")
+	// ErrInvalidRequest is returned when a request frame cannot be parsed
+	ErrInvalidRequest = errors.Error("invalid request")
+)
+
+const (
+	// DefaultWriteTimeout is the default time allowed to write a response, requesters which do not read their responses in time are disconnected
+	DefaultWriteTimeout = time.Second * 10
+)
+
+const (
+	// statusOK is prefixed to responses for successful requests
+	statusOK byte = iota
+	// statusError is prefixed to responses for requests whose handler returned an error
+	statusError
+)
+
+// RemoteError is an error returned by the handler of a responder
+// Note: Transport errors (such as errors.ErrIsClosed or conn.ErrIsIdle) are never a RemoteError
+type RemoteError string
+
+// Error will return the error message provided by the responder
+func (e RemoteError) Error() string {
+	return string(e)
+}
+
+// appendID will append a request id to buf
+func appendID(buf []byte, id uint64) []byte {
+	var d [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(d[:], id)
+	return append(buf, d[:n]...)
+}
+
+// readID will read a request id from the beginning of b and return the remaining bytes
+func readID(b []byte) (id uint64, rest []byte, ok bool) {
+	var n int
+	if id, n = binary.Uvarint(b); n <= 0 {
+		return
+	}
+
+	return id, b[n:], true
+}
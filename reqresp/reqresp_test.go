@@ -0,0 +1,523 @@
+package reqresp
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/missionMeteora/mq.v2/conn"
+	"github.com/missionMeteora/mq.v2/internal/testtls"
+	"github.com/missionMeteora/mq.v2/transport"
+	"github.com/missionMeteora/mq.v2/utilities"
+	"github.com/missionMeteora/toolkit/errors"
+)
+
+const testAddr = ":16778"
+
+func TestReqResp(t *testing.T) {
+	var (
+		r   *Responder
+		err error
+	)
+
+	ba := utilities.NewBasicAuth("foo", "bar")
+
+	if r, err = NewResponder(testAddr, func(b []byte) ([]byte, error) {
+		return append([]byte("echo "), b...), nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	r.OnConnect(ba.Check)
+	go r.Listen()
+
+	var wg sync.WaitGroup
+	wg.Add(4)
+
+	for i := 0; i < 4; i++ {
+		go func(i int) {
+			defer wg.Done()
+
+			req := NewRequester(testAddr)
+			req.OnConnect(ba.Auth)
+			defer req.Close()
+
+			for j := 0; j < 10; j++ {
+				var (
+					msg      string
+					expected = fmt.Sprintf("echo %d-%d", i, j)
+				)
+
+				if err := req.Request([]byte(fmt.Sprintf("%d-%d", i, j)), func(b []byte) {
+					msg = string(b)
+				}); err != nil {
+					t.Error(err)
+					return
+				}
+
+				if msg != expected {
+					t.Errorf("invalid message, expected '%s' and received '%s'", expected, msg)
+					return
+				}
+			}
+		}(i)
+	}
+
+	wg.Wait()
+
+	if err = r.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestResponderClose(t *testing.T) {
+	var (
+		r   *Responder
+		err error
+	)
+
+	if r, err = NewResponder(testAddr, func(b []byte) ([]byte, error) {
+		return b, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	go r.Listen()
+
+	req := NewRequester(testAddr)
+	if err = req.Request(testVal, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		// Close should not block on the idle requester connection
+		done <- r.Close()
+	}()
+
+	select {
+	case err = <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+
+	case <-time.After(time.Second):
+		t.Fatal("responder close timed out")
+	}
+
+	if err = req.Request(testVal, nil); err == nil {
+		t.Fatal("expected error when requesting from a closed responder")
+	}
+
+	req.Close()
+}
+
+var testVal = []byte("hello world!")
+
+func TestRemoteError(t *testing.T) {
+	var (
+		r   *Responder
+		err error
+	)
+
+	if r, err = NewResponder(testAddr, func(b []byte) ([]byte, error) {
+		if string(b) == "fail" {
+			return nil, errors.Error("handler failure")
+		}
+
+		return b, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	go r.Listen()
+
+	req := NewRequester(testAddr)
+	defer req.Close()
+
+	err = req.Request([]byte("fail"), func([]byte) {
+		t.Error("fn should not be called for failed requests")
+	})
+
+	if rerr, ok := err.(RemoteError); !ok {
+		t.Fatalf("invalid error, expected RemoteError and received %v", err)
+	} else if rerr.Error() != "handler failure" {
+		t.Fatalf("invalid error message, expected '%s' and received '%s'", "handler failure", rerr.Error())
+	}
+
+	// An empty response should be distinguishable from an error
+	var called bool
+	if err = req.Request(nil, func(b []byte) {
+		called = true
+		if len(b) != 0 {
+			t.Errorf("invalid response length, expected 0 and received %d", len(b))
+		}
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if !called {
+		t.Fatal("fn was not called for an empty response")
+	}
+}
+
+func TestPipelined(t *testing.T) {
+	var (
+		r   *Responder
+		err error
+	)
+
+	if r, err = NewResponder(testAddr, func(b []byte) ([]byte, error) {
+		if string(b) == "slow" {
+			time.Sleep(time.Millisecond * 200)
+		}
+
+		return b, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	r.SetWorkers(4)
+	go r.Listen()
+
+	req := NewRequester(testAddr)
+	defer req.Close()
+
+	slow := make(chan error, 1)
+	go func() {
+		slow <- req.Request([]byte("slow"), nil)
+	}()
+
+	// Give the slow request a head start so it is in-flight on the shared connection
+	time.Sleep(time.Millisecond * 20)
+
+	var wg sync.WaitGroup
+	wg.Add(100)
+	start := time.Now()
+
+	for i := 0; i < 100; i++ {
+		go func(i int) {
+			defer wg.Done()
+
+			var (
+				msg      string
+				expected = fmt.Sprintf("fast %d", i)
+			)
+
+			if err := req.Request([]byte(expected), func(b []byte) {
+				msg = string(b)
+			}); err != nil {
+				t.Error(err)
+				return
+			}
+
+			if msg != expected {
+				t.Errorf("invalid message, expected '%s' and received '%s'", expected, msg)
+			}
+		}(i)
+	}
+
+	wg.Wait()
+
+	if d := time.Since(start); d > time.Millisecond*150 {
+		t.Fatalf("fast requests were blocked by the slow request, took %v", d)
+	}
+
+	select {
+	case err = <-slow:
+		t.Fatalf("slow request returned before fast requests, error: %v", err)
+	default:
+	}
+
+	if err = <-slow; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRequestContext(t *testing.T) {
+	var (
+		r   *Responder
+		err error
+	)
+
+	if r, err = NewResponder(testAddr, func(b []byte) ([]byte, error) {
+		if string(b) == "slow" {
+			time.Sleep(time.Millisecond * 100)
+		}
+
+		return b, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	go r.Listen()
+
+	req := NewRequester(testAddr)
+	defer req.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*20)
+	defer cancel()
+
+	if err = req.RequestContext(ctx, []byte("slow"), func([]byte) {
+		t.Error("fn should not be called for timed out requests")
+	}); err != context.DeadlineExceeded {
+		t.Fatalf("invalid error, expected %v and received %v", context.DeadlineExceeded, err)
+	}
+
+	// Our connection should still be usable, and the late response should be discarded
+	var msg string
+	if err = req.Request(testVal, func(b []byte) {
+		msg = string(b)
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if msg != string(testVal) {
+		t.Fatalf("invalid message, expected '%s' and received '%s'", testVal, msg)
+	}
+}
+
+func TestTLS(t *testing.T) {
+	var (
+		r   *Responder
+		err error
+	)
+
+	sc, cc := testtls.New(t)
+
+	if r, err = NewResponder(testAddr, func(b []byte) ([]byte, error) {
+		return b, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	r.SetTLS(sc)
+	r.OnConnect(utilities.NewCertAuth(testtls.ClientName).Check)
+
+	go r.Listen()
+
+	req := NewRequester(testAddr)
+	defer req.Close()
+
+	req.SetTLS(cc)
+	req.OnConnect(utilities.NewCertAuth("localhost").Check)
+
+	if err = req.Request(testVal, func(b []byte) {
+		if string(b) != string(testVal) {
+			t.Errorf("invalid response, expected %s and received %s", testVal, b)
+		}
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Requesters without a client certificate should be rejected
+	anon := NewRequester(testAddr)
+	defer anon.Close()
+
+	anon.SetTLS(&tls.Config{RootCAs: cc.RootCAs, ServerName: cc.ServerName})
+	if err = anon.Request(testVal, func([]byte) {}); err == nil {
+		t.Fatal("expected requester without a client certificate to be rejected")
+	}
+}
+
+func TestInproc(t *testing.T) {
+	var (
+		r   *Responder
+		err error
+	)
+
+	if r, err = NewResponder("inproc://reqresp", func(b []byte) ([]byte, error) {
+		return b, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	go r.Listen()
+
+	req := NewRequester("inproc://reqresp")
+	defer req.Close()
+
+	for i := 0; i < 10; i++ {
+		if err = req.Request(testVal, func(b []byte) {
+			if string(b) != string(testVal) {
+				t.Errorf("invalid response, expected %s and received %s", testVal, b)
+			}
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestMessageHeaders(t *testing.T) {
+	var (
+		r   *Responder
+		err error
+	)
+
+	if r, err = NewMessageResponder("inproc://headers", func(req conn.Message) (resp conn.Message, err error) {
+		resp.Headers = conn.Headers{"trace-id": req.Headers["trace-id"]}
+		resp.Body = req.Body
+		return
+	}); err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	go r.Listen()
+
+	req := NewRequester("inproc://headers")
+	defer req.Close()
+
+	var resp conn.Message
+	if err = req.RequestMessage(context.Background(), conn.Message{Headers: conn.Headers{"trace-id": "abc123"}, Body: testVal}, func(m conn.Message) {
+		resp.Headers = m.Headers
+		resp.Body = append(resp.Body[:0], m.Body...)
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if resp.Headers["trace-id"] != "abc123" || string(resp.Body) != string(testVal) {
+		t.Fatalf("invalid response, received %v and %s", resp.Headers, resp.Body)
+	}
+
+	// Requests without headers are handled as regular requests
+	if err = req.Request(testVal, func(b []byte) {
+		if string(b) != string(testVal) {
+			t.Errorf("invalid response, expected %s and received %s", testVal, b)
+		}
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWriteTimeout(t *testing.T) {
+	var (
+		r   *Responder
+		err error
+	)
+
+	if r, err = NewResponder("inproc://stuck", func(b []byte) ([]byte, error) {
+		return b, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	// A single worker would be stalled by our stuck requester if it's writes were not bounded
+	r.SetWorkers(1)
+	r.SetWriteTimeout(time.Millisecond * 50)
+
+	dc := make(chan struct{}, 1)
+	r.OnDisconnect(func(conn.Conn) {
+		dc <- struct{}{}
+	})
+
+	go r.Listen()
+
+	// Our stuck requester sends requests, but never reads it's responses
+	nc, err := transport.Dial(context.Background(), "inproc://stuck")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stuck := conn.New()
+	if err = stuck.Connect(nc); err != nil {
+		t.Fatal(err)
+	}
+	defer stuck.Close()
+
+	// The first response stalls our worker, the second is queued behind it
+	for i := uint64(0); i < 2; i++ {
+		if err = stuck.Put(append(appendID(nil, i), testVal...)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	select {
+	case <-dc:
+	case <-time.After(time.Second):
+		t.Fatal("stuck requester was not disconnected")
+	}
+
+	req := NewRequester("inproc://stuck")
+	defer req.Close()
+
+	if err = req.Request(testVal, func(b []byte) {
+		if string(b) != string(testVal) {
+			t.Errorf("invalid response, expected %s and received %s", testVal, b)
+		}
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConnectContext(t *testing.T) {
+	// Our listener accepts connections, but never completes the handshake
+	l, err := transport.Listen("inproc://silent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	go func() {
+		for {
+			if _, err := l.Accept(); err != nil {
+				return
+			}
+		}
+	}()
+
+	req := NewRequester("inproc://silent")
+
+	var wg sync.WaitGroup
+	// The first request dials, the others wait on it's dial
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+			defer cancel()
+
+			start := time.Now()
+			if err := req.RequestContext(ctx, testVal, nil); err != context.DeadlineExceeded {
+				t.Errorf("invalid error, expected %v and received %v", context.DeadlineExceeded, err)
+			}
+
+			if d := time.Since(start); d > time.Second {
+				t.Errorf("request ignored it's context while connecting, returned after %v", d)
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	// Closing should not wait on an in-flight dial
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go req.RequestContext(ctx, testVal, nil)
+	time.Sleep(time.Millisecond * 10)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- req.Close()
+	}()
+
+	select {
+	case err = <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+
+	case <-time.After(time.Second):
+		t.Fatal("requester close timed out")
+	}
+}
@@ -1,27 +1,317 @@
 package reqresp
 
 import (
+	"context"
+	"crypto/tls"
+	"net"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/missionMeteora/journaler"
 	"github.com/missionMeteora/mq.v2/conn"
+	"github.com/missionMeteora/mq.v2/transport"
+	"github.com/missionMeteora/toolkit/errors"
 )
 
-// Response is the response type
-type Response struct {
-	c  conn.Conn
-	fn func(byte) (resp []byte, err error)
+// NewResponder will return a new responder listening on the provided address
+// Note: Addresses may be prefixed with a transport scheme (e.g. unix:///tmp/resp.sock or inproc://users), the default is tcp
+func NewResponder(addr string, fn Handler) (rp *Responder, err error) {
+	return NewMessageResponder(addr, func(req conn.Message) (resp conn.Message, err error) {
+		resp.Body, err = fn(req.Body)
+		return
+	})
+}
+
+// NewMessageResponder will return a new responder listening on the provided address, fn is provided the headers of each request
+// Note: Addresses are handled the same as NewResponder
+func NewMessageResponder(addr string, fn MessageHandler) (rp *Responder, err error) {
+	var r Responder
+	if r.l, err = transport.Listen(addr); err != nil {
+		return
+	}
+
+	r.fn = fn
+	r.cm = make(map[string]conn.Conn)
+	r.out = journaler.New("Responder", addr)
+	r.onDC = append(r.onDC, r.remove)
+	r.workers = runtime.NumCPU()
+	r.wto = DefaultWriteTimeout
+	r.jobs = make(chan *job, r.workers)
+	r.jp = sync.Pool{New: func() interface{} { return &job{} }}
+
+	rp = &r
+	return
+}
+
+// Responder is the responding side of a request/response pair
+type Responder struct {
+	mux sync.RWMutex
+	// Wait group for connection read loops
+	wg sync.WaitGroup
+	// Wait group for workers
+	wwg sync.WaitGroup
+	out *journaler.Journaler
+
+	l  net.Listener
+	fn MessageHandler
+
+	// Connection options
+	opts conn.Opts
+
+	// Requester map
+	cm map[string]conn.Conn
+
+	// Job queue
+	jobs chan *job
+	// Job pool
+	jp sync.Pool
+	// Number of workers
+	workers int
+	// Time allowed to write a response
+	wto time.Duration
+
+	// On connect functions
+	onC []conn.OnConnectFn
+	// On disconnect functions
+	onDC []conn.OnDisconnectFn
+
+	closed bool
 }
 
-func (r *Response) listen() {
-	var err error
+func (r *Responder) remove(c conn.Conn) {
+	r.mux.Lock()
+	delete(r.cm, c.Key())
+	r.mux.Unlock()
+}
+
+func (r *Responder) close(wg *sync.WaitGroup) (errs *errors.ErrorList) {
+	errs = &errors.ErrorList{}
+	if r.closed {
+		errs.Push(errors.ErrIsClosed)
+		return
+	}
+
+	r.closed = true
+	errs.Push(r.l.Close())
+
+	wg.Add(len(r.cm))
+	for _, c := range r.cm {
+		go func(c conn.Conn) {
+			// The read loop may already be closing this connection, which is not an error for us
+			if err := c.Close(); err != errors.ErrIsClosed {
+				errs.Push(err)
+			}
+
+			wg.Done()
+		}(c)
+	}
+
+	return
+}
+
+// connect will connect a new net.Conn and begin serving it
+func (r *Responder) connect(nc net.Conn) {
+	r.mux.RLock()
+	c := conn.NewWithOpts(r.opts).OnConnect(r.onC...).OnDisconnect(r.onDC...)
+	r.mux.RUnlock()
+
+	if err := c.Connect(nc); err != nil {
+		r.out.Error("", err)
+		nc.Close()
+		return
+	}
+
+	r.mux.Lock()
+	if r.closed {
+		r.mux.Unlock()
+		c.Close()
+		return
+	}
+
+	r.cm[c.Key()] = c
+	r.wg.Add(1)
+	r.mux.Unlock()
+
+	go r.serve(c)
+}
+
+// serve will read requests for a connection and pass them to the workers until the connection closes
+func (r *Responder) serve(c conn.Conn) {
+	defer r.wg.Done()
+
+	var j *job
+	fn := func(m conn.Message) {
+		id, b, ok := readID(m.Body)
+		if !ok {
+			r.out.Error("", ErrInvalidRequest)
+			return
+		}
+
+		// The request bytes are only valid during this call, so we copy them into the job
+		j = r.jp.Get().(*job)
+		j.c = c
+		j.id = id
+		j.hdrs = m.Headers
+		j.req = append(j.req[:0], b...)
+	}
+
 	for {
-		var resp []byte
-		if err = r.c.Get(func(b []byte) {
-			resp, err = r.fn(b)
-		}); err != nil {
-			// Handle error
+		if err := c.GetMessage(fn); err != nil {
+			break
 		}
 
-		if err = r.c.Put(resp); err != nil {
-			return
+		if j != nil {
+			r.jobs <- j
+			j = nil
+		}
+	}
+
+	// Closing will remove the connection from our map and call the OnDisconnect funcs
+	c.Close()
+}
+
+// work will process jobs until the job queue is closed
+func (r *Responder) work() {
+	defer r.wwg.Done()
+
+	var buf []byte
+	for j := range r.jobs {
+		resp, err := r.fn(conn.Message{Headers: j.hdrs, Body: j.req})
+		buf = newResponse(appendID(buf[:0], j.id), resp.Body, err)
+		if err != nil {
+			// Error responses do not carry headers
+			resp.Headers = nil
 		}
+
+		r.respond(j.c, conn.Message{Headers: resp.Headers, Body: buf})
+
+		j.c = nil
+		j.hdrs = nil
+		r.jp.Put(j)
+	}
+}
+
+// respond will put a response, requesters which do not read it within our write timeout are disconnected
+// Note: A failed put means the connection is closing, which is handled by the read loop
+func (r *Responder) respond(c conn.Conn, m conn.Message) {
+	ctx, cancel := context.WithTimeout(context.Background(), r.wto)
+	defer cancel()
+
+	err := c.PutMessageContext(ctx, m)
+	if err == conn.ErrUnsupportedVersion {
+		// Our requester does not support headers, respond without them
+		err = c.PutContext(ctx, m.Body)
+	}
+
+	if err == context.DeadlineExceeded {
+		// Our requester is not reading, drop it so our workers are not stalled
+		c.Close()
+	}
+}
+
+// SetWorkers will set the number of workers used to process requests, the default is runtime.NumCPU()
+// Note: This function is intended to be called before Listen, it is NOT thread-safe
+func (r *Responder) SetWorkers(n int) {
+	if n < 1 {
+		n = 1
 	}
+
+	r.workers = n
+}
+
+// SetWriteTimeout will set the time allowed to write a response, the default is DefaultWriteTimeout
+// Note: This function is intended to be called before Listen, it is NOT thread-safe
+func (r *Responder) SetWriteTimeout(d time.Duration) {
+	r.wto = d
+}
+
+// SetOpts will set the connection options used for new requesters (e.g. heartbeats)
+// Note: This function is intended to be called before Listen, it is NOT thread-safe
+func (r *Responder) SetOpts(opts conn.Opts) {
+	r.opts = opts
+}
+
+// SetTLS will require requesters to connect over TLS using the provided config
+// Note: Set cfg.ClientAuth to tls.RequireAndVerifyClientCert for mutual TLS, OnConnect funcs can then identify requesters by their certificate
+// Note: This function is intended to be called before Listen, it is NOT thread-safe
+func (r *Responder) SetTLS(cfg *tls.Config) {
+	r.l = tls.NewListener(r.l, cfg)
+}
+
+// Listen will listen for inbound requesters
+// Note: Listen will block until the responder is closed
+func (r *Responder) Listen() {
+	r.wwg.Add(r.workers)
+	for i := 0; i < r.workers; i++ {
+		go r.work()
+	}
+
+	for {
+		nc, err := r.l.Accept()
+		if err != nil {
+			break
+		}
+
+		go r.connect(nc)
+	}
+
+	// Our listener has closed, wait for our read loops to end before stopping the workers
+	r.wg.Wait()
+	close(r.jobs)
+}
+
+// OnConnect will append an OnConnect func
+func (r *Responder) OnConnect(fns ...conn.OnConnectFn) {
+	r.mux.Lock()
+	r.onC = append(r.onC, fns...)
+	r.mux.Unlock()
+}
+
+// OnDisconnect will append an onDisconnect func
+func (r *Responder) OnDisconnect(fns ...conn.OnDisconnectFn) {
+	r.mux.Lock()
+	r.onDC = append(r.onDC, fns...)
+	r.mux.Unlock()
+}
+
+// Close will close the responder
+func (r *Responder) Close() error {
+	var wg sync.WaitGroup
+	r.mux.Lock()
+	errs := r.close(&wg)
+	r.mux.Unlock()
+	wg.Wait()
+	r.wg.Wait()
+	r.wwg.Wait()
+	return errs.Err()
+}
+
+// newResponse will append a response frame to buf and return the resulting slice
+// Note: If err is not nil, the error message is sent in place of resp
+func newResponse(buf, resp []byte, err error) []byte {
+	if err != nil {
+		buf = append(buf, statusError)
+		return append(buf, err.Error()...)
+	}
+
+	buf = append(buf, statusOK)
+	return append(buf, resp...)
+}
+
+// Handler is called for each inbound request and returns the response
+// Note: If an error is returned, the requester will receive it as a RemoteError
+// Note: Handlers are called concurrently from the responder's workers
+type Handler func(req []byte) (resp []byte, err error)
+
+// MessageHandler is called for each inbound request along with it's headers and returns the response and it's headers
+// Note: Errors are handled the same as Handler, the request body is only valid during the call
+type MessageHandler func(req conn.Message) (resp conn.Message, err error)
+
+// job is a request waiting to be processed by a worker
+type job struct {
+	c    conn.Conn
+	id   uint64
+	req  []byte
+	hdrs conn.Headers
 }
@@ -0,0 +1,129 @@
+package transport
+
+import (
+	"context"
+	"net"
+	"sync"
+
+	"github.com/missionMeteora/toolkit/errors"
+)
+
+func newInproc() *inproc {
+	return &inproc{
+		lm: make(map[string]*inprocListener),
+	}
+}
+
+// inproc is an in-process transport, dialed connections are paired with accepted connections using net.Pipe
+type inproc struct {
+	mux sync.RWMutex
+	// Listeners by address
+	lm map[string]*inprocListener
+}
+
+// Listen will listen on an address
+func (ip *inproc) Listen(addr string) (l net.Listener, err error) {
+	ip.mux.Lock()
+	defer ip.mux.Unlock()
+
+	if _, ok := ip.lm[addr]; ok {
+		return nil, ErrAddrInUse
+	}
+
+	il := inprocListener{
+		ip:    ip,
+		addr:  inprocAddr(addr),
+		conns: make(chan net.Conn),
+		done:  make(chan struct{}),
+	}
+
+	ip.lm[addr] = &il
+	return &il, nil
+}
+
+// Dial will dial an address
+func (ip *inproc) Dial(ctx context.Context, addr string) (nc net.Conn, err error) {
+	ip.mux.RLock()
+	il, ok := ip.lm[addr]
+	ip.mux.RUnlock()
+
+	if !ok {
+		return nil, ErrConnRefused
+	}
+
+	s, c := net.Pipe()
+	select {
+	case il.conns <- s:
+		return c, nil
+
+	case <-il.done:
+		err = ErrConnRefused
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	s.Close()
+	c.Close()
+	return nil, err
+}
+
+// remove will remove a listener if it is still registered for it's address
+func (ip *inproc) remove(il *inprocListener) {
+	ip.mux.Lock()
+	if ip.lm[string(il.addr)] == il {
+		delete(ip.lm, string(il.addr))
+	}
+	ip.mux.Unlock()
+}
+
+// inprocListener is an in-process listener
+type inprocListener struct {
+	ip   *inproc
+	addr inprocAddr
+
+	// Accepted connections
+	conns chan net.Conn
+	// Closed when the listener is closed
+	done chan struct{}
+	once sync.Once
+}
+
+// Accept will wait for and return the next connection
+func (il *inprocListener) Accept() (net.Conn, error) {
+	select {
+	case nc := <-il.conns:
+		return nc, nil
+	case <-il.done:
+		return nil, errors.ErrIsClosed
+	}
+}
+
+// Close will close the listener
+func (il *inprocListener) Close() (err error) {
+	err = errors.ErrIsClosed
+	il.once.Do(func() {
+		il.ip.remove(il)
+		close(il.done)
+		err = nil
+	})
+
+	return
+}
+
+// Addr will return the listener's address
+func (il *inprocListener) Addr() net.Addr {
+	return il.addr
+}
+
+// inprocAddr is an in-process address
+type inprocAddr string
+
+// Network will return the network name
+func (a inprocAddr) Network() string {
+	return "inproc"
+}
+
+// String will return the address
+func (a inprocAddr) String() string {
+	return string(a)
+}
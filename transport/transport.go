@@ -0,0 +1,158 @@
+package transport
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/missionMeteora/toolkit/errors"
+)
+
+const (
+	// ErrUnknownScheme is returned when an address uses a scheme without a registered transport
+	ErrUnknownScheme = errors.Error("unknown transport scheme")
+	// ErrConnRefused is returned when dialing an in-process address without a listener
+	ErrConnRefused = errors.Error("connection refused")
+	// ErrAddrInUse is returned when listening on an in-process address which already has a listener
+	ErrAddrInUse = errors.Error("address already in use")
+)
+
+const (
+	// schemeSep separates the scheme from the address (e.g. unix:///tmp/mq.sock)
+	schemeSep = "://"
+	// defaultScheme is used for addresses without a scheme
+	defaultScheme = "tcp"
+)
+
+var (
+	// TCP is the TCP transport, addresses are host:port (e.g. tcp://localhost:16777)
+	TCP Transport = netTransport("tcp")
+	// Unix is the Unix domain socket transport, addresses are socket paths (e.g. unix:///tmp/mq.sock)
+	Unix Transport = netTransport("unix")
+	// Inproc is the in-process transport, addresses are names (e.g. inproc://events)
+	// Connections are in-memory pipes, so they are only reachable from within the same process
+	Inproc Transport = newInproc()
+)
+
+var (
+	mux sync.RWMutex
+	// Transports by scheme
+	tm = map[string]Transport{
+		"tcp":    TCP,
+		"unix":   Unix,
+		"inproc": Inproc,
+	}
+)
+
+// Transport is a means of listening for and dialing connections
+type Transport interface {
+	Listen(addr string) (l net.Listener, err error)
+	Dial(ctx context.Context, addr string) (nc net.Conn, err error)
+}
+
+// Register will register a transport for a scheme, replacing any existing transport for the scheme
+func Register(scheme string, t Transport) {
+	mux.Lock()
+	tm[scheme] = t
+	mux.Unlock()
+}
+
+// Parse will return the transport and transport address for an address
+// Note: Addresses without a scheme (e.g. localhost:16777) use the TCP transport
+func Parse(url string) (t Transport, addr string, err error) {
+	scheme := defaultScheme
+	addr = url
+	if i := strings.Index(url, schemeSep); i != -1 {
+		scheme, addr = url[:i], url[i+len(schemeSep):]
+	}
+
+	mux.RLock()
+	t, ok := tm[scheme]
+	mux.RUnlock()
+
+	if !ok {
+		return nil, "", ErrUnknownScheme
+	}
+
+	return
+}
+
+// Listen will listen on an address
+func Listen(url string) (l net.Listener, err error) {
+	var (
+		t    Transport
+		addr string
+	)
+
+	if t, addr, err = Parse(url); err != nil {
+		return
+	}
+
+	return t.Listen(addr)
+}
+
+// Dial will dial an address
+func Dial(ctx context.Context, url string) (nc net.Conn, err error) {
+	var (
+		t    Transport
+		addr string
+	)
+
+	if t, addr, err = Parse(url); err != nil {
+		return
+	}
+
+	return t.Dial(ctx, addr)
+}
+
+// DialTLS will dial an address and complete a TLS handshake
+// Note: When cfg.ServerName is empty, the host of the address is used to verify the peer
+func DialTLS(ctx context.Context, url string, cfg *tls.Config) (nc net.Conn, err error) {
+	var (
+		t    Transport
+		addr string
+	)
+
+	if t, addr, err = Parse(url); err != nil {
+		return
+	}
+
+	if nc, err = t.Dial(ctx, addr); err != nil {
+		return
+	}
+
+	if cfg.ServerName == "" {
+		host := addr
+		if h, _, serr := net.SplitHostPort(addr); serr == nil {
+			host = h
+		}
+
+		cfg = cfg.Clone()
+		cfg.ServerName = host
+	}
+
+	// The deadline and cancellation of ctx are applied to the handshake
+	tc := tls.Client(nc, cfg)
+	if err = tc.HandshakeContext(ctx); err != nil {
+		nc.Close()
+		return nil, err
+	}
+
+	return tc, nil
+}
+
+// netTransport is a transport provided by the net package, the value is the network name
+type netTransport string
+
+// Listen will listen on an address
+func (n netTransport) Listen(addr string) (net.Listener, error) {
+	return net.Listen(string(n), addr)
+}
+
+// Dial will dial an address
+func (n netTransport) Dial(ctx context.Context, addr string) (net.Conn, error) {
+	var d net.Dialer
+	return d.DialContext(ctx, string(n), addr)
+}
@@ -0,0 +1,169 @@
+package transport
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		url  string
+		t    Transport
+		addr string
+		err  error
+	}{
+		{"localhost:16777", TCP, "localhost:16777", nil},
+		{"tcp://localhost:16777", TCP, "localhost:16777", nil},
+		{"unix:///tmp/mq.sock", Unix, "/tmp/mq.sock", nil},
+		{"inproc://events", Inproc, "events", nil},
+		{"carrier-pigeon://coop", nil, "", ErrUnknownScheme},
+	}
+
+	for _, tt := range tests {
+		tr, addr, err := Parse(tt.url)
+		if err != tt.err {
+			t.Fatalf("invalid error for %s, expected %v and received %v", tt.url, tt.err, err)
+		}
+
+		if tr != tt.t || addr != tt.addr {
+			t.Fatalf("invalid result for %s, expected %v %s and received %v %s", tt.url, tt.t, tt.addr, tr, addr)
+		}
+	}
+}
+
+func TestInproc(t *testing.T) {
+	var (
+		l   net.Listener
+		err error
+	)
+
+	if l, err = Listen("inproc://test"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = Listen("inproc://test"); err != ErrAddrInUse {
+		t.Fatalf("invalid error, expected %v and received %v", ErrAddrInUse, err)
+	}
+
+	testPair(t, l, "inproc://test")
+	l.Close()
+
+	if _, err = Dial(context.Background(), "inproc://test"); err != ErrConnRefused {
+		t.Fatalf("invalid error, expected %v and received %v", ErrConnRefused, err)
+	}
+
+	// Our address should be free once the listener is closed
+	if l, err = Listen("inproc://test"); err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	// Dials without an accept should respect their context
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*10)
+	defer cancel()
+
+	if _, err = Dial(ctx, "inproc://test"); err != context.DeadlineExceeded {
+		t.Fatalf("invalid error, expected %v and received %v", context.DeadlineExceeded, err)
+	}
+}
+
+func TestUnix(t *testing.T) {
+	var (
+		dir string
+		l   net.Listener
+		err error
+	)
+
+	if dir, err = ioutil.TempDir("", "transport"); err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	url := "unix://" + filepath.Join(dir, "test.sock")
+	if l, err = Listen(url); err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	testPair(t, l, url)
+}
+
+func TestDialTLSCancel(t *testing.T) {
+	// Our listener accepts connections, but never completes the TLS handshake
+	l, err := Listen("inproc://tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	go func() {
+		for {
+			if _, err := l.Accept(); err != nil {
+				return
+			}
+		}
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(time.Millisecond*20, cancel)
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := DialTLS(ctx, "inproc://tls", &tls.Config{})
+		done <- err
+	}()
+
+	select {
+	case err = <-done:
+		if err == nil {
+			t.Fatal("expected an error from a canceled TLS dial")
+		}
+
+	case <-time.After(time.Second):
+		t.Fatal("canceling did not abort the TLS handshake")
+	}
+}
+
+// testPair will dial a listener and ensure data can be exchanged between both ends
+func testPair(t *testing.T, l net.Listener, url string) {
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		nc, err := l.Accept()
+		if err != nil {
+			close(accepted)
+			return
+		}
+
+		accepted <- nc
+	}()
+
+	c, err := Dial(context.Background(), url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	s, ok := <-accepted
+	if !ok {
+		t.Fatal("accept failed")
+	}
+	defer s.Close()
+
+	go c.Write([]byte("hello"))
+
+	buf := make([]byte, 5)
+	if _, err = io.ReadFull(s, buf); err != nil {
+		t.Fatal(err)
+	}
+
+	if string(buf) != "hello" {
+		t.Fatalf("invalid message, expected %s and received %s", "hello", buf)
+	}
+}
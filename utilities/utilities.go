@@ -1,9 +1,12 @@
 package utilities
 
 import (
+	"context"
+	"crypto/tls"
 	"net"
 
 	"github.com/missionMeteora/mq.v2/conn"
+	"github.com/missionMeteora/mq.v2/transport"
 	"github.com/missionMeteora/toolkit/errors"
 )
 
@@ -69,10 +72,56 @@ func (b *BasicAuth) Auth(c conn.Conn) (err error) {
 	return
 }
 
+// NewCertAuth will return a new certificate auth which accepts peers with any of the provided names
+func NewCertAuth(names ...string) *CertAuth {
+	ca := CertAuth{
+		names: make(map[string]struct{}, len(names)),
+	}
+
+	for _, name := range names {
+		ca.names[name] = struct{}{}
+	}
+
+	return &ca
+}
+
+// CertAuth is a certificate authentication middleware, it requires connections to be established over TLS
+// Peers are identified by the common name or DNS names of their verified certificate
+type CertAuth struct {
+	names map[string]struct{}
+}
+
+// Check will check the peer certificate of a connection
+func (ca *CertAuth) Check(c conn.Conn) (err error) {
+	for _, name := range PeerNames(c) {
+		if _, ok := ca.names[name]; ok {
+			return
+		}
+	}
+
+	return ErrInvalidCredentials
+}
+
+// PeerNames will return the common name and DNS names of a connection's verified peer certificate
+// Note: Nil is returned when the connection is not using TLS or the peer certificate has not been verified
+func PeerNames(c conn.Conn) (names []string) {
+	cs := c.TLS()
+	if cs == nil || len(cs.VerifiedChains) == 0 {
+		return
+	}
+
+	leaf := cs.VerifiedChains[0][0]
+	if leaf.Subject.CommonName != "" {
+		names = append(names, leaf.Subject.CommonName)
+	}
+
+	return append(names, leaf.DNSNames...)
+}
+
 // Listen will listen and return a net connection
 func Listen(addr string) (nc net.Conn, err error) {
 	var l net.Listener
-	if l, err = net.Listen("tcp", addr); err != nil {
+	if l, err = transport.Listen(addr); err != nil {
 		return
 	}
 	defer l.Close()
@@ -82,5 +131,23 @@ func Listen(addr string) (nc net.Conn, err error) {
 
 // Dial will dial a requested address and return a
 func Dial(addr string) (nc net.Conn, err error) {
-	return net.Dial("tcp", addr)
+	return transport.Dial(context.Background(), addr)
+}
+
+// ListenTLS will listen for a TLS connection and return it
+func ListenTLS(addr string, cfg *tls.Config) (nc net.Conn, err error) {
+	var l net.Listener
+	if l, err = transport.Listen(addr); err != nil {
+		return
+	}
+
+	l = tls.NewListener(l, cfg)
+	defer l.Close()
+
+	return l.Accept()
+}
+
+// DialTLS will dial a requested address over TLS and return the connection
+func DialTLS(addr string, cfg *tls.Config) (nc net.Conn, err error) {
+	return transport.DialTLS(context.Background(), addr, cfg)
 }
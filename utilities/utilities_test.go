@@ -1,12 +1,14 @@
 package utilities
 
 import (
+	"crypto/tls"
 	"net"
 	"sync"
 	"testing"
 	"time"
 
 	"github.com/missionMeteora/mq.v2/conn"
+	"github.com/missionMeteora/mq.v2/internal/testtls"
 )
 
 func TestBasicAuth(t *testing.T) {
@@ -113,3 +115,54 @@ func TestBasicAuthFail(t *testing.T) {
 
 	wg.Wait()
 }
+
+func TestCertAuth(t *testing.T) {
+	sc, cc := testtls.New(t)
+
+	testCertAuth(t, sc, cc, NewCertAuth(testtls.ClientName), nil)
+	testCertAuth(t, sc, cc, NewCertAuth("someone else"), ErrInvalidCredentials)
+}
+
+func testCertAuth(t *testing.T, sc, cc *tls.Config, ca *CertAuth, expected error) {
+	done := make(chan error, 1)
+
+	go func() {
+		var (
+			s   = conn.New()
+			nc  net.Conn
+			err error
+		)
+
+		if nc, err = ListenTLS(":16777", sc); err != nil {
+			done <- err
+			return
+		}
+
+		s.OnConnect(ca.Check)
+		done <- s.Connect(nc)
+		s.Close()
+	}()
+
+	time.Sleep(time.Millisecond * 10)
+
+	var (
+		c   = conn.New()
+		nc  net.Conn
+		err error
+	)
+
+	if nc, err = DialTLS("127.0.0.1:16777", cc); err != nil {
+		t.Fatal(err)
+	}
+
+	// The client can identify the server as well
+	c.OnConnect(NewCertAuth("localhost").Check)
+	if err = c.Connect(nc); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if err = <-done; err != expected {
+		t.Fatalf("invalid error, expected %v and received %v", expected, err)
+	}
+}